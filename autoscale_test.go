@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+//输入结束、worker 都已经退出之后，controller 才处理一次缩容的 tick
+//缩容需要一个 worker 接收 quit，这时已经没有 worker 了，stage 不能因此卡住
+func TestAutoscaleInputEndsOnScaleDownTick(t *testing.T) {
+	for range 20 {
+		synctest.Test(t, func(t *testing.T) {
+			clock := NewFakeClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+			resume := make(chan struct{})
+			stage := Autoscale(func(n int) int { return n }, Workers(1, 2), ScaleEvery(time.Second), OnScale(func(d ScaleDecision) {
+				if d.Reason == "backlog" {
+					<-resume
+				}
+			}))
+			in := make(chan int)
+			out := stage(WithClock(context.Background(), clock), in)
+
+			//第一个 worker 阻塞在输出上，剩下的元素排队，第一次 tick 扩容，controller 停在 OnScale 中
+			for i := 1; i <= 3; i++ {
+				in <- i
+			}
+			synctest.Wait()
+			go clock.Advance(time.Second)
+			synctest.Wait()
+
+			//读完所有的输出并结束输入，worker 全部退出，下一次 tick 时 worker 都是空闲的
+			var got []int
+			for range 3 {
+				got = append(got, <-out)
+			}
+			close(in)
+			synctest.Wait()
+			go clock.Advance(time.Second)
+			synctest.Wait()
+
+			close(resume)
+			for v := range out {
+				got = append(got, v)
+			}
+			if len(got) != 3 {
+				t.Fatalf("got %v, want 3 items", got)
+			}
+		})
+	}
+}
+
+//ScaleEvery 不大于 0 时按 minWindow 处理，而不是让 NewTicker panic
+func TestAutoscaleNonPositiveInterval(t *testing.T) {
+	nums := seq(1, 20)
+	got, err := Collect(context.Background(), Then(From(FromSlice(nums)), Autoscale(func(n int) int { return n }, ScaleEvery(0))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(nums) {
+		t.Fatalf("got %v, want %d items", got, len(nums))
+	}
+}
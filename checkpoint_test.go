@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+var errCrash = errors.New("crash")
+
+//写入 limit 行之后失败，模拟进程在写入时崩溃
+type crashWriter struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (w *crashWriter) Write(p []byte) (int, error) {
+	for i, b := range p {
+		if w.limit >= 0 && strings.Count(w.buf.String(), "\n") >= w.limit {
+			return i, errCrash
+		}
+		w.buf.WriteByte(b)
+	}
+	return len(p), nil
+}
+
+func (w *crashWriter) ints(t *testing.T) []int {
+	t.Helper()
+	var got []int
+	for _, line := range strings.Fields(w.buf.String()) {
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, n)
+	}
+	return got
+}
+
+//运行一次可恢复的累加，每个元素处理 1 秒，每 3 秒提交一次
+func runResumable(t *testing.T, path string, w *crashWriter) (*Checkpointer, error) {
+	t.Helper()
+	cp, err := OpenCheckpoint(path, 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow := Lift(MapStage(func(n int) int {
+		time.Sleep(time.Second)
+		return n
+	}))
+	flow := Then(Then(From(Resume(cp, FromSlice(seq(1, 10)))), slow), ResumableScan(cp, "sum", 0, add))
+	_, err = RunTo(context.Background(), flow, CheckpointSink(cp, w, LinesFormat[int]()))
+	return cp, err
+}
+
+//写入第 8 个结果时崩溃，恢复之后从最后一次提交的 offset 和累加状态继续，每个结果至少输出一次
+func TestCheckpointCrashAndResume(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "checkpoint.json")
+		want := []int{1, 3, 6, 10, 15, 21, 28, 36, 45, 55}
+
+		crashed := &crashWriter{limit: 7}
+		cp, err := runResumable(t, path, crashed)
+		if !errors.Is(err, errCrash) {
+			t.Fatalf("err = %v, want the crash", err)
+		}
+		//第 3、6 个结果之后各提交了一次，第 9 个结果写入时崩溃
+		if got := cp.Offset(); got != 6 {
+			t.Fatalf("committed offset = %d, want 6", got)
+		}
+		if got := crashed.ints(t); !slices.Equal(got, want[:7]) {
+			t.Fatalf("before crash = %v", got)
+		}
+
+		resumed := &crashWriter{limit: -1}
+		cp, err = runResumable(t, path, resumed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//从 offset 6 重放，累加的状态恢复为前 6 个元素的和，第 7 个结果重复了一次
+		if got := resumed.ints(t); !slices.Equal(got, want[6:]) {
+			t.Fatalf("after resume = %v, want %v", got, want[6:])
+		}
+		if got := cp.Offset(); got != 10 {
+			t.Fatalf("committed offset = %d, want 10", got)
+		}
+
+		//已经全部提交，再运行一次不会有任何输出
+		again := &crashWriter{limit: -1}
+		if _, err := runResumable(t, path, again); err != nil {
+			t.Fatal(err)
+		}
+		if again.buf.Len() != 0 {
+			t.Fatalf("output after completion: %q", again.buf.String())
+		}
+	})
+}
+
+//提交时使用处理完 offset 之前的元素时的状态，而不是最新的状态
+func TestResumableScanHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	cp, err := OpenCheckpoint(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, _ := withRunState(context.Background())
+	in := make(chan Record[int])
+	out := ResumableScan(cp, "sum", 0, add)(ctx, in)
+	go func() {
+		defer close(in)
+		for i := range 5 {
+			in <- Record[int]{int64(i), i + 1}
+		}
+	}()
+	for range out {
+	}
+
+	//offset 3 之前的元素是 1、2、3
+	if err := cp.commit(3); err != nil {
+		t.Fatal(err)
+	}
+	var state int
+	if ok, err := cp.loadState("sum", &state); !ok || err != nil || state != 6 {
+		t.Fatalf("state = %d, %v, %v, want 6", state, ok, err)
+	}
+	if err := cp.commit(5); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := cp.loadState("sum", &state); !ok || err != nil || state != 15 {
+		t.Fatalf("state = %d, %v, %v, want 15", state, ok, err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//RunPipeExpr 在 Registry 的副本中注册 stdin 数据源，调用者的 Registry 不受影响
+func TestRunPipeExprRegistry(t *testing.T) {
+	r := NewRegistry()
+	var stdout, stderr bytes.Buffer
+	if err := RunPipeExpr(r, "square | sum", strings.NewReader("1\n2\n3\n"), &stdout, &stderr); err != nil {
+		t.Fatal(err, stderr.String())
+	}
+	if got := stdout.String(); got != "14\n" {
+		t.Fatalf("stdout = %q, want %q", got, "14\n")
+	}
+	if _, ok := r.sources["stdin"]; ok {
+		t.Fatal("stdin source registered in the caller's registry")
+	}
+}
+
+func TestParsePipeExprRange(t *testing.T) {
+	r := NewRegistry()
+	for _, expr := range []string{"echo 1..100 | sum", "range 1..100 | sum"} {
+		def, err := ParsePipeExpr(r, expr)
+		if err != nil {
+			t.Fatal(expr, err)
+		}
+		want := StageDef{"range", Params{"from": 1, "to": 100}}
+		if !reflect.DeepEqual(def.Source, want) {
+			t.Fatalf("%s: source = %v, want %v", expr, def.Source, want)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	if err := RunPipeExpr(r, "echo 1..100 | sum", strings.NewReader(""), &stdout, &stderr); err != nil {
+		t.Fatal(err, stderr.String())
+	}
+	if got := stdout.String(); got != "5050\n" {
+		t.Fatalf("stdout = %q, want %q", got, "5050\n")
+	}
+
+	for _, expr := range []string{"echo 1..x", "echo 1..3 5", "window_sum 1..3"} {
+		if _, err := ParsePipeExpr(r, expr); err == nil {
+			t.Errorf("%s: want error", expr)
+		}
+	}
+}
+
+//和 RunPipeExpr 一样，nil 的 Registry 表示内置的 Registry
+func TestParsePipeExprNilRegistry(t *testing.T) {
+	def, err := ParsePipeExpr(nil, "echo 1 2 3 | square")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ParsePipeExpr(NewRegistry(), "echo 1 2 3 | square")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(def, want) {
+		t.Fatalf("got %+v, want %+v", def, want)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+//嵌套的数据源只在最外层的闸门计数
+func TestStatusEmittedNested(t *testing.T) {
+	inner := From(FromSlice([]int{1, 2, 3})).Pipe(MapStage(func(n int) int { return n * 2 }))
+	sorted := MergeSortedSources(strings.Compare, FromSlice([]string{"a", "c"}), FromSlice([]string{"b", "d"}))
+	for name, run := range map[string]func() (int, *Handle){
+		"flow": func() (int, *Handle) {
+			out, h := From(inner.Source()).Run(context.Background())
+			return drainCount(out), h
+		},
+		"merge sorted": func() (int, *Handle) {
+			out, h := From(sorted).Run(context.Background())
+			return drainCount(out), h
+		},
+	} {
+		n, h := run()
+		if err := h.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		if st := h.Status(); st.Emitted != int64(n) {
+			t.Fatalf("%s: emitted %d, got %d items", name, st.Emitted, n)
+		}
+	}
+}
+
+func drainCount[T any](out <-chan T) int {
+	n := 0
+	for range out {
+		n++
+	}
+	return n
+}
+
+//数据源在 Drain 时可能正在发送一个已经产生的元素，这个元素也要交给下游
+func TestDrainKeepsProducedItems(t *testing.T) {
+	for range 50 {
+		produced := 0
+		src := Generate(func() (int, bool) {
+			produced++
+			return produced, true
+		})
+		for name, f := range map[string]*Flow[int]{
+			"source": From(src),
+			"nested": From(From(src).Pipe(MapStage(func(n int) int { return n })).Source()),
+		} {
+			produced = 0
+			out, h := f.Pipe(MapStage(func(n int) int { return n * 2 })).Run(context.Background())
+			for range 4 {
+				<-out
+			}
+			drained := make(chan error, 1)
+			go func() {
+				drained <- h.Drain()
+			}()
+			got := 4 + drainCount(out)
+			if err := <-drained; err != nil {
+				t.Fatal(err)
+			}
+			st := h.Status()
+			if got != produced || st.Emitted != int64(got) || st.State != Finished {
+				t.Fatalf("%s: produced %d, got %d, status %+v", name, produced, got, st)
+			}
+		}
+	}
+}
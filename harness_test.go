@@ -0,0 +1,131 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+func add(acc, n int) int {
+	return acc + n
+}
+
+func TestHarnessSynchronousSlidingTime(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		h := NewStageHarness(t, SlidingTime(time.Second, time.Second, 0, add), Synchronous())
+		h.Send(1, 2)
+		h.Advance(time.Second)
+		h.Send(5)
+		ExpectEmissions(t, h.Close(), Emission[int]{3, time.Second}, Emission[int]{5, time.Second})
+	})
+}
+
+func TestHarnessSynchronousDebounce(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		h := NewStageHarness(t, Debounce[int](time.Second), Synchronous())
+		h.Send(1)
+		h.Advance(500 * time.Millisecond)
+		h.Send(2)
+		h.Advance(time.Second)
+		h.Send(3)
+		h.Advance(2 * time.Second)
+		ExpectEmissions(t, h.Close(), Emission[int]{2, 1500 * time.Millisecond}, Emission[int]{3, 2500 * time.Millisecond})
+	})
+}
+
+func TestHarnessSynchronousThrottle(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		h := NewStageHarness(t, Throttle[int](time.Second), Synchronous())
+		h.Send(1, 2)
+		h.Clock.Advance(time.Second)
+		h.Send(3)
+		ExpectEmissions(t, h.Close(), Emission[int]{1, 0}, Emission[int]{3, time.Second})
+	})
+}
+
+//定时器在 stage 自己的 goroutine 中创建，推进时钟之前需要等待
+func TestHarnessAsyncDebounce(t *testing.T) {
+	h := NewStageHarness(t, Debounce[int](time.Second))
+	h.Send(1)
+	h.Clock.WaitForTimers(1)
+	h.Advance(time.Second)
+	h.Send(2)
+	ExpectValues(t, h.Close(), 1, 2)
+}
+
+func TestHarnessAsyncSample(t *testing.T) {
+	h := NewStageHarness(t, Sample[int](time.Second))
+	h.Clock.WaitForTimers(1)
+	h.Send(1, 2)
+	h.Advance(time.Second)
+	h.Send(3)
+	h.Advance(time.Second)
+	h.Advance(time.Second)
+	//非同步模式下输出的时间不精确，只比较值
+	ExpectValues(t, h.Close(), 2, 3)
+	if err := h.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpectHelpers(t *testing.T) {
+	got := []Emission[int]{{1, 0}, {2, time.Second}}
+	ExpectValues(t, got, 1, 2)
+	ExpectValuesUnordered(t, got, 2, 1)
+	ExpectTimes(t, got, 0, time.Second)
+
+	for _, expect := range []func(TB){
+		func(t TB) { ExpectValues(t, got, 2, 1) },
+		func(t TB) { ExpectValuesUnordered(t, got, 1, 3) },
+		func(t TB) { ExpectTimes(t, got, 0) },
+	} {
+		if !fails(expect) {
+			t.Fatal("mismatched emissions were accepted")
+		}
+	}
+}
+
+//和 *testing.T 一样，Fatalf 结束当前的 goroutine
+type fakeTB struct {
+	failed bool
+}
+
+func (*fakeTB) Helper() {}
+
+func (f *fakeTB) Fatalf(string, ...any) {
+	f.failed = true
+	runtime.Goexit()
+}
+
+func fails(fn func(TB)) bool {
+	var ft fakeTB
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn(&ft)
+	}()
+	<-done
+	return ft.failed
+}
+
+//stage 需要推进时钟才能接收下一个元素，SendAsync 把元素留在队列中
+func TestHarnessSendAsyncQueue(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		h := NewStageHarness(t, RateLimit[int](1, MaxPending(1)), Synchronous())
+		h.SendAsync(1, 2, 3)
+		h.Advance(time.Second)
+		h.Advance(time.Second)
+		ExpectEmissions(t, h.Close(), Emission[int]{1, 0}, Emission[int]{2, time.Second}, Emission[int]{3, 2 * time.Second})
+	})
+}
+
+//Send 在 stage 接收所有元素之后返回，Close 会发送完队列中剩下的元素
+func TestHarnessSendOrder(t *testing.T) {
+	h := NewStageHarness(t, MapStage(func(n int) int { return n * 10 }))
+	h.Send(1, 2)
+	h.SendAsync(3, 4)
+	h.Send(5)
+	h.SendAsync(6)
+	ExpectValues(t, h.Close(), 10, 20, 30, 40, 50, 60)
+}
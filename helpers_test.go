@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"sync"
+	"testing/synctest"
+	"time"
+)
+
+//测试 Pipeline 的工具
+//和时间相关的 stage 依赖真实的时间，测试只能 sleep 并容忍误差；并发的 stage 输出的顺序和时机也不固定
+//这里提供三样东西，让测试可以确定地运行：
+//	FakeClock：手动推进的虚拟时钟，通过 WithClock 交给 pipeline
+//	StageHarness：逐个向 stage 发送元素、推进时钟，并收集输出以及输出时的虚拟时间
+//	Expect 系列函数：比较收集到的输出，包括顺序和时间
+//这些工具只在测试中使用，放在 _test.go 文件中，不会编译进 go run pipeline*.go 的程序：
+//	go test pipeline*.go *_test.go
+//例如在 _test.go 中测试一个每秒输出一次的滚动窗口：
+//	synctest.Test(t, func(t *testing.T) {
+//		h := NewStageHarness(t, SlidingTime(time.Second, time.Second, 0, add), Synchronous())
+//		h.Send(1, 2)
+//		h.Advance(time.Second)
+//		h.Send(5)
+//		ExpectEmissions(t, h.Close(), Emission[int]{3, time.Second}, Emission[int]{5, time.Second})
+//	})
+
+//虚拟时钟，只有调用 Advance 时时间才会前进
+//Advance 按照时间顺序逐个触发到期的定时器，每次触发都会等到 stage 接收之后才继续，
+//所以跨越多个周期时，ticker 的每一次触发都不会丢失
+//Advance 只能在一个 goroutine 中调用
+type FakeClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	seq    int
+	timers []*fakeTimer
+	//每次触发定时器之后调用，用来等待 stage 处理完成，见 Synchronous
+	settle func()
+}
+
+type fakeTimer struct {
+	clock  *FakeClock
+	c      chan time.Time
+	stop   chan struct{}
+	when   time.Time
+	period time.Duration
+	//同一时间到期的定时器按照创建的顺序触发
+	seq int
+}
+
+func NewFakeClock(start time.Time) *FakeClock {
+	c := &FakeClock{now: start}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) Timer {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.NewTicker")
+	}
+	return c.newTimer(d, d)
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	return c.newTimer(d, 0)
+}
+
+func (c *FakeClock) newTimer(d, period time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	t := &fakeTimer{
+		clock:  c,
+		c:      make(chan time.Time),
+		stop:   make(chan struct{}),
+		when:   c.now.Add(d),
+		period: period,
+		seq:    c.seq,
+	}
+	c.timers = append(c.timers, t)
+	c.cond.Broadcast()
+	return t
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-t.stop:
+		return
+	default:
+	}
+	close(t.stop)
+	c.remove(t)
+}
+
+func (c *FakeClock) remove(t *fakeTimer) {
+	if i := slices.Index(c.timers, t); i >= 0 {
+		c.timers = slices.Delete(c.timers, i, i+1)
+		c.cond.Broadcast()
+	}
+}
+
+//到 end 为止最先到期的定时器
+func (c *FakeClock) next(end time.Time) *fakeTimer {
+	var next *fakeTimer
+	for _, t := range c.timers {
+		if t.when.After(end) {
+			continue
+		}
+		if next == nil || t.when.Before(next.when) || (t.when.Equal(next.when) && t.seq < next.seq) {
+			next = t
+		}
+	}
+	return next
+}
+
+//把时间推进 d，依次触发这段时间内到期的定时器
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		t := c.next(end)
+		if t == nil {
+			break
+		}
+		c.now = t.when
+		if t.period > 0 {
+			t.when = t.when.Add(t.period)
+		} else {
+			c.remove(t)
+		}
+		now := c.now
+		c.mu.Unlock()
+
+		//不持有锁发送，stage 在接收之前可能会调用 Now 或者 Stop
+		select {
+		case t.c <- now:
+		case <-t.stop:
+		}
+		if c.settle != nil {
+			c.settle()
+		}
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+//等待至少有 n 个没有停止的定时器
+//stage 在自己的 goroutine 中创建定时器，在此之前推进时钟，定时器会从推进之后的时间开始计时
+func (c *FakeClock) WaitForTimers(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+//测试中用到的 *testing.T 的方法，*testing.T 和 *testing.B 都满足这个接口
+type TB interface {
+	Helper()
+	Fatalf(format string, args ...any)
+}
+
+//stage 的一个输出，At 是输出时虚拟时钟距离开始时经过的时间
+type Emission[T any] struct {
+	Value T
+	At    time.Duration
+}
+
+type harnessConfig struct {
+	start time.Time
+	sync  bool
+}
+
+type HarnessOption func(*harnessConfig)
+
+//虚拟时钟的起始时间，默认是 2000-01-01 00:00:00 UTC
+func StartAt(t time.Time) HarnessOption {
+	return func(c *harnessConfig) {
+		c.start = t
+	}
+}
+
+//同步执行：每次 Send 和每次触发定时器之后，都等待所有 goroutine 处理完成并阻塞，
+//这时 Emission 的时间是精确的，测试也不需要调用 WaitForTimers
+//需要在 synctest.Test 中运行，stage 中的所有 goroutine 都处于同一个 bubble 中
+func Synchronous() HarnessOption {
+	return func(c *harnessConfig) {
+		c.sync = true
+	}
+}
+
+//驱动一个 stage 运行的测试工具，使用 FakeClock 作为时钟
+//输入先放入队列，由一个单独的 goroutine 依次发送给 stage，
+//输出由另一个 goroutine 不断收集，stage 不会因为没有人读取而阻塞
+type StageHarness[A, B any] struct {
+	Clock *FakeClock
+
+	t   TB
+	cfg harnessConfig
+	ctx context.Context
+	h   *Handle
+
+	qmu       sync.Mutex
+	queue     []A
+	closed    bool
+	delivered int
+	//队列中有新的元素或者 stage 接收了一个元素时通知
+	queued   chan struct{}
+	progress chan struct{}
+
+	mu   sync.Mutex
+	got  []Emission[B]
+	done chan struct{}
+}
+
+func NewStageHarness[A, B any](t TB, stage Stage[A, B], opts ...HarnessOption) *StageHarness[A, B] {
+	t.Helper()
+	cfg := harnessConfig{start: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	sh := &StageHarness[A, B]{
+		Clock:    NewFakeClock(cfg.start),
+		t:        t,
+		cfg:      cfg,
+		queued:   make(chan struct{}, 1),
+		progress: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	if cfg.sync {
+		sh.Clock.settle = synctest.Wait
+	}
+
+	//不经过 From，From 会在数据源后面加一道闸门，Send 返回时元素只是到了闸门，stage 还没有接收
+	in := make(chan A)
+	ctx, rs := withRunState(WithClock(context.Background(), sh.Clock))
+	sh.ctx, sh.h = ctx, &Handle{state: rs}
+	out := stage(ctx, in)
+	go sh.feed(in)
+	go func() {
+		defer close(sh.done)
+		for v := range out {
+			at := sh.Clock.Now().Sub(cfg.start)
+			sh.mu.Lock()
+			sh.got = append(sh.got, Emission[B]{v, at})
+			sh.mu.Unlock()
+		}
+	}()
+	sh.settle()
+	return sh
+}
+
+//把队列中的元素依次发送给 stage，队列关闭并且为空时关闭 in
+//只使用 channel 等待，Synchronous 模式下空闲时处于阻塞状态
+func (sh *StageHarness[A, B]) feed(in chan<- A) {
+	for {
+		sh.qmu.Lock()
+		if len(sh.queue) == 0 {
+			closed := sh.closed
+			sh.qmu.Unlock()
+			if closed {
+				close(in)
+				return
+			}
+			select {
+			case <-sh.queued:
+				continue
+			case <-sh.ctx.Done():
+				return
+			}
+		}
+		v := sh.queue[0]
+		sh.queue = sh.queue[1:]
+		sh.qmu.Unlock()
+
+		if !send(sh.ctx, in, v) {
+			return
+		}
+		sh.qmu.Lock()
+		sh.delivered++
+		sh.qmu.Unlock()
+		notify(sh.progress)
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (sh *StageHarness[A, B]) settle() {
+	if sh.cfg.sync {
+		synctest.Wait()
+	}
+}
+
+//把元素放入队列，返回放入之后一共发送过的元素个数
+func (sh *StageHarness[A, B]) enqueue(vs []A) int {
+	sh.qmu.Lock()
+	defer sh.qmu.Unlock()
+	sh.queue = append(sh.queue, vs...)
+	notify(sh.queued)
+	return sh.delivered + len(sh.queue)
+}
+
+//按顺序发送元素
+//Synchronous 模式下等待 stage 处理完所有能够接收的元素之后返回，stage 等待时钟时剩下的元素留在队列中；
+//否则等到所有元素都被 stage 接收之后返回，stage 需要推进时钟才能继续接收时使用 SendAsync
+//非同步模式下 stage 接收之后的处理可能还没有完成，例如 Throttle 接收之后才读取时钟，这时需要使用 Synchronous
+//stage 已经失败退出时放弃发送
+func (sh *StageHarness[A, B]) Send(vs ...A) {
+	target := sh.enqueue(vs)
+	if sh.cfg.sync {
+		synctest.Wait()
+		return
+	}
+	for {
+		sh.qmu.Lock()
+		delivered := sh.delivered
+		sh.qmu.Unlock()
+		if delivered >= target {
+			return
+		}
+		select {
+		case <-sh.progress:
+		case <-sh.ctx.Done():
+			return
+		}
+	}
+}
+
+//把元素放入队列之后立即返回
+func (sh *StageHarness[A, B]) SendAsync(vs ...A) {
+	sh.enqueue(vs)
+	sh.settle()
+}
+
+//推进虚拟时钟
+func (sh *StageHarness[A, B]) Advance(d time.Duration) {
+	sh.Clock.Advance(d)
+	sh.settle()
+}
+
+//到目前为止收集到的输出
+func (sh *StageHarness[A, B]) Output() []Emission[B] {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return slices.Clone(sh.got)
+}
+
+//结束输入，等待队列中的元素发送完、stage 退出，返回所有的输出
+func (sh *StageHarness[A, B]) Close() []Emission[B] {
+	sh.qmu.Lock()
+	sh.closed = true
+	notify(sh.queued)
+	sh.qmu.Unlock()
+	<-sh.done
+	sh.h.Wait()
+	return sh.Output()
+}
+
+//stage 报告的错误，在 Close 之后调用
+func (sh *StageHarness[A, B]) Err() error {
+	return sh.h.Err()
+}
+
+//运行 f 并收集所有的输出
+func Collect[T any](ctx context.Context, f *Flow[T]) ([]T, error) {
+	out, h := f.Run(ctx)
+	var got []T
+	for v := range out {
+		got = append(got, v)
+	}
+	return got, h.Wait()
+}
+
+func emissionValues[T any](got []Emission[T]) []T {
+	values := make([]T, len(got))
+	for i, e := range got {
+		values[i] = e.Value
+	}
+	return values
+}
+
+//输出的值和顺序都与 want 相同
+func ExpectValues[T any](t TB, got []Emission[T], want ...T) {
+	t.Helper()
+	values := emissionValues(got)
+	if len(values) != len(want) || (len(want) > 0 && !reflect.DeepEqual(values, want)) {
+		t.Fatalf("values = %v, want %v", values, want)
+	}
+}
+
+//输出的值与 want 相同，不比较顺序，用于并行的 stage
+func ExpectValuesUnordered[T any](t TB, got []Emission[T], want ...T) {
+	t.Helper()
+	values := emissionValues(got)
+	rest := slices.Clone(want)
+	for _, v := range values {
+		i := slices.IndexFunc(rest, func(w T) bool {
+			return reflect.DeepEqual(v, w)
+		})
+		if i < 0 {
+			t.Fatalf("values = %v, want %v in any order: unexpected %v", values, want, v)
+		}
+		rest = slices.Delete(rest, i, i+1)
+	}
+	if len(rest) > 0 {
+		t.Fatalf("values = %v, want %v in any order: missing %v", values, want, rest)
+	}
+}
+
+//输出的值和输出的时间都与 want 相同
+func ExpectEmissions[T any](t TB, got []Emission[T], want ...Emission[T]) {
+	t.Helper()
+	if len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+		t.Fatalf("emissions = %s, want %s", formatEmissions(got), formatEmissions(want))
+	}
+}
+
+//每个输出的时间依次与 want 相同，不比较值
+func ExpectTimes[T any](t TB, got []Emission[T], want ...time.Duration) {
+	t.Helper()
+	times := make([]time.Duration, len(got))
+	for i, e := range got {
+		times[i] = e.At
+	}
+	if !slices.Equal(times, want) {
+		t.Fatalf("emission times = %v, want %v", times, want)
+	}
+}
+
+func formatEmissions[T any](es []Emission[T]) string {
+	s := "["
+	for i, e := range es {
+		if i > 0 {
+			s += " "
+		}
+		s += fmt.Sprintf("%v@%v", e.Value, e.At)
+	}
+	return s + "]"
+}
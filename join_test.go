@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+type joinKV struct {
+	Key   string
+	Value int
+}
+
+//harness 只有一个输入，把带有 Left 标记的元素分到两个 channel 上再连接
+//两个 channel 都没有缓冲，元素按照发送的顺序到达 joinChans
+type joinInput struct {
+	Left bool
+	joinKV
+}
+
+func joinLeft(key string, v int) joinInput { return joinInput{true, joinKV{key, v}} }
+func joinRight(key string, v int) joinInput { return joinInput{false, joinKV{key, v}} }
+
+type joinOut = Joined[string, joinKV, joinKV]
+
+func joinStage(opts ...JoinOption) Stage[joinInput, joinOut] {
+	var cfg joinConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	key := func(kv joinKV) string { return kv.Key }
+	return func(ctx context.Context, in <-chan joinInput) <-chan joinOut {
+		lc, rc := make(chan joinKV), make(chan joinKV)
+		goStage(ctx, func() {
+			defer close(lc)
+			defer close(rc)
+			for x := range in {
+				ch := rc
+				if x.Left {
+					ch = lc
+				}
+				if !send(ctx, ch, x.joinKV) {
+					return
+				}
+			}
+		})
+		return joinChans(ctx, lc, rc, key, key, &cfg)
+	}
+}
+
+func matched(l, r joinInput) joinOut {
+	return joinOut{Key: l.Key, Left: l.joinKV, Right: r.joinKV, Side: Matched}
+}
+
+func leftOnly(l joinInput) joinOut {
+	return joinOut{Key: l.Key, Left: l.joinKV, Side: LeftOnly}
+}
+
+func rightOnly(r joinInput) joinOut {
+	return joinOut{Key: r.Key, Right: r.joinKV, Side: RightOnly}
+}
+
+//按时间划分窗口：窗口内配对，过期的元素由定时器淘汰并作为 outer 的结果输出，输入结束时输出剩下的元素
+func TestJoinWithin(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		h := NewStageHarness(t, joinStage(JoinWithin(time.Second), LeftOuter(), RightOuter()), Synchronous())
+		a1, a2, b, ra := joinLeft("a", 1), joinLeft("a", 2), joinLeft("b", 3), joinRight("a", 10)
+		//一个元素可以和窗口内多个元素配对
+		h.Send(a1, a2, b, ra)
+		//b 在窗口内没有配对，1s 之后过期
+		h.Advance(time.Second)
+		rc := joinRight("c", 20)
+		h.Send(rc)
+		h.Advance(time.Second)
+		//e 过期之后才到达右边的 e，不能配对
+		le := joinLeft("e", 4)
+		h.Send(le)
+		h.Advance(time.Second)
+		re, rd := joinRight("e", 30), joinRight("d", 40)
+		h.Send(re, rd)
+		ExpectEmissions(t, h.Close(),
+			Emission[joinOut]{matched(a1, ra), 0},
+			Emission[joinOut]{matched(a2, ra), 0},
+			Emission[joinOut]{leftOnly(b), time.Second},
+			Emission[joinOut]{rightOnly(rc), 2 * time.Second},
+			Emission[joinOut]{leftOnly(le), 3 * time.Second},
+			Emission[joinOut]{rightOnly(re), 3 * time.Second},
+			Emission[joinOut]{rightOnly(rd), 3 * time.Second},
+		)
+	})
+}
+
+//按元素个数划分窗口：滑出窗口的元素不能再配对，没有设置 RightOuter 时右边没有配对的元素被丢弃
+func TestJoinLast(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		h := NewStageHarness(t, joinStage(JoinLast(2), LeftOuter()), Synchronous())
+		a, b, c := joinLeft("a", 1), joinLeft("b", 2), joinLeft("c", 3)
+		ra, rb := joinRight("a", 10), joinRight("b", 20)
+		h.Send(a, b, c, ra, rb)
+		ExpectEmissions(t, h.Close(),
+			Emission[joinOut]{leftOnly(a), 0},
+			Emission[joinOut]{matched(b, rb), 0},
+			Emission[joinOut]{leftOnly(c), 0},
+		)
+	})
+}
+
+//不设置 outer 时只输出配对成功的结果
+func TestJoinInner(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		h := NewStageHarness(t, joinStage(JoinWithin(time.Second)), Synchronous())
+		a, b := joinLeft("a", 1), joinLeft("b", 2)
+		rb, ra, rb2 := joinRight("b", 20), joinRight("a", 10), joinRight("b", 21)
+		h.Send(a, rb)
+		h.Advance(time.Second)
+		//a 和 rb 已经过期
+		h.Send(b, ra, rb2)
+		ExpectEmissions(t, h.Close(), Emission[joinOut]{matched(b, rb2), time.Second})
+	})
+}
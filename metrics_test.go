@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"testing/synctest"
+)
+
+//原始 pipeline 中的 stage 也有处理耗时
+func TestInstrumentPipeLatency(t *testing.T) {
+	m := NewMetrics()
+	for range pipeline([]int{1, 2, 3, 4}, echo, InstrumentPipe(m, "square", square), InstrumentPipe(m, "odd", odd)) {
+	}
+	for _, s := range m.Snapshot() {
+		if s.Latency.Count != s.Out {
+			t.Fatalf("%s: latency count %d, out %d", s.Name, s.Latency.Count, s.Out)
+		}
+	}
+}
+
+//stage 跟不上时，元素在 Instrument 的队列中排队
+func TestInstrumentQueue(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		m := NewMetrics()
+		release := make(chan struct{})
+		slow := MapStage(func(n int) int {
+			<-release
+			return n
+		})
+		nums := make([]int, 10)
+		out, h := From(FromSlice(nums)).Pipe(Instrument(m, "slow", slow, QueueSize(4))).Run(context.Background())
+		synctest.Wait()
+		if s := m.Snapshot()[0]; s.QueueLen != 4 || s.QueueCap != 4 {
+			t.Fatalf("queue = %d/%d, want 4/4", s.QueueLen, s.QueueCap)
+		}
+
+		close(release)
+		n := 0
+		for range out {
+			n++
+		}
+		if err := h.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		s := m.Snapshot()[0]
+		if n != 10 || s.QueueLen != 0 || s.In != 10 || s.Latency.Count != 10 {
+			t.Fatalf("got %d items, snapshot %+v", n, s)
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func explode(n int) int {
+	return 100 / (n - 2)
+}
+
+//原始 pipeline 中的 panic 被转换为这条 pipeline 的错误，名字来自 stage
+func TestPipePanic(t *testing.T) {
+	out, h := pipelineWithHandle([]int{1, 2, 3}, echo, AutoscalePipe(explode), square, sum)
+	for range out {
+	}
+	var pe *PanicError
+	if err := h.Wait(); !errors.As(err, &pe) || pe.Stage != "Autoscale" {
+		t.Fatalf("err = %v, want a PanicError from Autoscale", err)
+	}
+
+	pipeRuns.mu.Lock()
+	defer pipeRuns.mu.Unlock()
+	for _, ctx := range pipeRuns.byChan {
+		if getRunState(ctx) == h.state {
+			t.Fatal("channels of the pipeline are still registered")
+		}
+	}
+}
+
+//一条 pipeline 失败不会影响同时运行的其他 pipeline
+func TestPipePanicIsolated(t *testing.T) {
+	healthy, hh := pipelineWithHandle([]int{1, 2, 3}, echo, square, sum)
+	//没有读取输出的 pipeline 不会阻塞其他 pipeline 的 Wait
+	abandoned := pipeline([]int{1, 2, 3}, echo, square)
+	<-abandoned
+
+	out, h := pipelineWithHandle([]int{1, 2, 3}, echo, AutoscalePipe(explode), sum)
+	for range out {
+	}
+	waited := make(chan error)
+	go func() { waited <- h.Wait() }()
+	select {
+	case err := <-waited:
+		if err == nil {
+			t.Fatal("want an error from the failed pipeline")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wait blocked on another pipeline")
+	}
+
+	var got []int
+	for n := range healthy {
+		got = append(got, n)
+	}
+	if len(got) != 1 || got[0] != 14 {
+		t.Fatalf("got %v, want [14]", got)
+	}
+	if err := hh.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//直接嵌套调用原始 stage 时，整条链共享一个运行状态，panic 之后下游不会输出不完整的结果
+func TestRawChainPanic(t *testing.T) {
+	var got []int
+	for n := range sum(AutoscalePipe(explode)(echo([]int{1, 2, 3}))) {
+		got = append(got, n)
+	}
+	if len(got) != 0 {
+		t.Fatalf("got %v, want no result", got)
+	}
+}
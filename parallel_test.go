@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"slices"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+//每个元素的处理时间是随机的，Ordered 仍然按输入的顺序输出
+func TestParallelOrderedRandomLatency(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		nums := seq(1, 200)
+		slow := MapStage(func(n int) int {
+			time.Sleep(time.Duration(rand.Intn(50)) * time.Millisecond)
+			return n * n
+		})
+		got, err := Collect(context.Background(), From(FromSlice(nums)).Pipe(Parallel(8, slow, Ordered)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := make([]int, len(nums))
+		for i, n := range nums {
+			want[i] = n * n
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	})
+}
+
+//在处理中途取消，下游不再读取输出，所有的 goroutine 仍然要退出
+func TestParallelCancelMidStream(t *testing.T) {
+	for name, mode := range map[string]MergeMode{"ordered": Ordered, "unordered": Unordered} {
+		t.Run(name, func(t *testing.T) {
+			n := 0
+			src := Generate(func() (int, bool) {
+				n++
+				return n, true
+			})
+			slow := MapStage(func(n int) int {
+				time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+				return n
+			})
+			ctx, cancel := context.WithCancel(context.Background())
+			out, h := From(src).Pipe(Parallel(4, slow, mode)).Run(ctx)
+			for range 20 {
+				<-out
+			}
+			cancel()
+
+			done := make(chan error, 1)
+			go func() { done <- h.Wait() }()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Handle.Wait did not return after cancel")
+			}
+		})
+	}
+}
@@ -1,62 +1,86 @@
 package main
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
 
 //Pipeline 模式
 
 //一个简单的示例
+//goroutine 通过 goStage 启动，stage 中的 panic 会被 recover，见 pipeline_panic.go
 func echo(nums []int) <-chan int {
 	out := make(chan int)
-	go func() {
+	ctx := pipeContext(nil)
+	goStage(ctx, func() {
+		defer close(out)
 		for _, n := range nums {
-			out <- n
+			if !send(ctx, out, n) {
+				return
+			}
 		}
-		close(out)
-	}()
+	})
 
-	return out
+	return pipeOutput(ctx, out)
 }
 
 //平方函数
 func square(in <-chan int) <-chan int {
 	out := make(chan int)
-	go func() {
+	ctx := pipeContext(in)
+	goStage(ctx, func() {
+		defer close(out)
 		for n := range in {
-			out <- n * n
+			if !send(ctx, out, n*n) {
+				return
+			}
 		}
-		close(out)
-	}()
+	})
 
-	return out
+	return pipeOutput(ctx, out)
 }
 
 //过滤奇数函数
 func odd(in <-chan int) <-chan int {
 	out := make(chan int)
-	go func() {
+	ctx := pipeContext(in)
+	goStage(ctx, func() {
+		defer close(out)
 		for n := range in {
 			if n % 2 == 1 {
-				out <- n * n
+				if !send(ctx, out, n*n) {
+					return
+				}
 			}
 		}
-		close(out)
-	}()
+	})
 
-	return out
+	return pipeOutput(ctx, out)
 }
 
 //求和函数
 func sum(in <-chan int) <-chan int {
 	out := make(chan int)
-	go func() {
+	ctx := pipeContext(in)
+	goStage(ctx, func() {
+		defer close(out)
 		sum := 0
 		for n := range in {
 			sum += n
 		}
-		out <- sum
-		close(out)
-	}()
-	return out
+		//上游出错时提前关闭，此时的结果是不完整的，不能输出
+		if ctx.Err() != nil {
+			return
+		}
+		send(ctx, out, sum)
+	})
+	return pipeOutput(ctx, out)
 }
 
 //func EchoFunc(in <-chan int, fn func(in <- chan int, out chan int)) <-chan int {
@@ -69,15 +93,21 @@ func sum(in <-chan int) <-chan int {
 type EchoFunc func([]int) <- chan int
 type PipeFunc func(in <-chan int) <-chan int
 
+//每次调用都有自己的运行状态，需要读取错误时使用 pipelineWithHandle，见 pipeline_panic.go
 func pipeline(nums []int, echoFunc EchoFunc, pipeFunc ...PipeFunc) <-chan int {
-	ch := echoFunc(nums)
-	for i := range pipeFunc {
-		ch = pipeFunc[i](ch)
-	}
-	return ch
+	out, _ := pipelineWithHandle(nums, echoFunc, pipeFunc...)
+	return out
 }
 
 func main() {
+	//带参数运行时，把参数作为管道表达式执行，见 pipeline_cli.go
+	if len(os.Args) > 1 {
+		if err := RunPipeExpr(nil, strings.Join(os.Args[1:], " "), os.Stdin, os.Stdout, os.Stderr); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
 	////简单的pipeline的使用方式
 	nums := []int{1, 2, 3, 4, 5, 6, 7}
 	for n := range square(echo(nums)) {
@@ -88,4 +118,303 @@ func main() {
 	for n := range pipeline(nums, echo, square, odd, sum) {
 		fmt.Println(n)
 	}
+
+	//使用 context 控制 pipeline，consumer 提前退出时不会泄漏 goroutine
+	out, h := pipelineWithContext(context.Background(), nums, ctxEcho, ctxSquare, ctxOdd)
+	fmt.Println(<-out)
+	h.Stop()
+
+	//泛型 pipeline：先把字符串解析为记录，再过滤和聚合
+	type record struct {
+		name  string
+		score int
+	}
+	lines := []string{"tom,90", "jerry,75", "spike,60"}
+	records := Then(From(FromSlice(lines)), MapStage(func(s string) record {
+		name, score, _ := strings.Cut(s, ",")
+		n, _ := strconv.Atoi(score)
+		return record{name, n}
+	}))
+	passed := records.Pipe(FilterStage(func(r record) bool { return r.score >= 70 }))
+	total, h := Then(passed, ReduceStage(0, func(acc int, r record) int { return acc + r.score })).Run(context.Background())
+	fmt.Println(<-total)
+	h.Wait()
+
+	//在 4 个 worker 上并行计算平方，Ordered 模式下输出顺序和输入一致
+	for n := range pipeline(nums, echo, ParallelPipe(4, square, Ordered)) {
+		fmt.Println(n)
+	}
+
+	//stage 返回错误时整个 pipeline 被取消，错误通过 Handle.Wait 返回
+	parsed, h := Then(From(FromSlice([]string{"1", "2", "x", "4"})), TryMap(strconv.Atoi)).Run(context.Background())
+	for n := range parsed {
+		fmt.Println(n)
+	}
+	if err := h.Wait(); err != nil {
+		fmt.Println("pipeline failed:", err)
+	}
+
+	//滑动窗口：每来一个元素，输出最近 3 个元素的和
+	rolling, h := Then(From(FromSlice(nums)), SlidingCount(3, 1, 0, func(acc, n int) int { return acc + n })).Run(context.Background())
+	for n := range rolling {
+		fmt.Println(n)
+	}
+	h.Wait()
+
+	//统计每个 stage 的指标，也可以通过 http.Handle("/metrics", m.Handler()) 导出给 Prometheus
+	m := NewMetrics()
+	for range pipeline(nums, echo, InstrumentPipe(m, "square", square), InstrumentPipe(m, "odd", odd)) {
+	}
+	for _, s := range m.Snapshot() {
+		fmt.Printf("stage=%s in=%d out=%d latency count=%d\n", s.Name, s.In, s.Out, s.Latency.Count)
+	}
+
+	//使用生成器作为数据源，不需要事先准备好所有的输入
+	i := 0
+	gen := Generate(func() (int, bool) {
+		i++
+		return i, i <= 10
+	})
+	for n := range pipeline(nil, AsEchoFunc(gen), square, sum) {
+		fmt.Println(n)
+	}
+
+	//从 io.Reader 中逐行读取数据
+	ints := Then(From(ReaderLines(strings.NewReader("3\n4\n5\n"))), TryMap(strconv.Atoi))
+	out, h = pipelineWithContext(context.Background(), nil, AsCtxEchoFunc(ints.Source()), ctxSquare, ctxSum)
+	fmt.Println(<-out)
+	h.Wait()
+
+	//一次调用运行整个 pipeline，结果以 JSON Lines 的格式写入标准输出
+	count, err := RunTo(context.Background(), From(FromSlice(nums)).Pipe(ctxSquare), JSONLinesSink[int](os.Stdout))
+	fmt.Printf("written=%d err=%v\n", count, err)
+
+	//同一个数据源同时交给 square 和 odd 处理，再把两个分支合并起来求和
+	branches := Broadcast(From(FromSlice(nums)), 2)
+	merged := MergeFlows(branches[0].Pipe(ctxSquare), branches[1].Pipe(ctxOdd)).Pipe(ctxSum)
+	out, h = merged.Run(context.Background())
+	fmt.Println(<-out)
+	h.Wait()
+
+	//失败的元素重试 3 次，仍然失败的进入死信 channel，不影响其他元素
+	dead := make(chan DeadLetter[string])
+	done := make(chan struct{})
+	go func() {
+		JSONLinesSink[DeadLetter[string]](os.Stdout)(dead)
+		close(done)
+	}()
+	retried := Then(From(FromSlice([]string{"1", "two", "3"})), Retry(strconv.Atoi, dead, MaxAttempts(3), Backoff(time.Millisecond, 10*time.Millisecond)))
+	count, err = RunTo(context.Background(), retried, LinesSink[int](os.Stdout))
+	close(dead)
+	<-done
+	fmt.Printf("written=%d err=%v\n", count, err)
+
+	//带 checkpoint 的 pipeline，进程崩溃后再次运行会从最后一次提交的 offset 继续
+	dir, _ := os.MkdirTemp("", "pipeline")
+	defer os.RemoveAll(dir)
+	cp, err := OpenCheckpoint(filepath.Join(dir, "checkpoint.json"), time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+	running := Then(From(Resume(cp, FromSlice(nums))), ResumableScan(cp, "sum", 0, func(acc, n int) int { return acc + n }))
+	count, err = RunTo(context.Background(), running, CheckpointSink(cp, os.Stdout, LinesFormat[int]()))
+	fmt.Printf("written=%d err=%v offset=%d\n", count, err, cp.Offset())
+
+	//从配置中加载 pipeline，等价于 pipeline(nums, echo, square, odd, sum)
+	def, err := ParsePipelineDef([]byte(`{
+		"source": {"name": "echo", "params": {"nums": [1, 2, 3, 4, 5, 6, 7]}},
+		"stages": [{"name": "square"}, {"name": "odd"}, {"name": "sum"}]
+	}`))
+	if err != nil {
+		log.Fatal(err)
+	}
+	flow, err := NewRegistry().Build(def)
+	if err != nil {
+		log.Fatal(err)
+	}
+	out, h = flow.Run(context.Background())
+	fmt.Println(<-out)
+	h.Wait()
+
+	//按奇偶分组求和
+	parity := func(n int) string {
+		if n%2 == 0 {
+			return "even"
+		}
+		return "odd"
+	}
+	groups, h := Then(From(FromSlice(nums)), GroupBy(parity, 0, func(acc, n int) int { return acc + n }, MaxKeys(100))).Run(context.Background())
+	for g := range groups {
+		fmt.Printf("%s=%d\n", g.Key, g.Value)
+	}
+	h.Wait()
+
+	//stage 中的 panic 不会让程序崩溃，而是作为错误返回
+	divide := Named("divide", MapStage(func(n int) int { return 100 / (n - 4) }))
+	out, h = From(FromSlice(nums)).Pipe(divide).Run(context.Background())
+	for range out {
+	}
+	if err := h.Wait(); err != nil {
+		fmt.Println("pipeline failed:", err)
+	}
+
+	//原始 pipeline 中的 panic 也不会让程序崩溃，这条 pipeline 退出，错误通过它的 Handle 读取
+	out, h = pipelineWithHandle(nums, echo, AutoscalePipe(func(n int) int { return 100 / (n - 4) }), sum)
+	for n := range out {
+		fmt.Println(n)
+	}
+	if err := h.Wait(); err != nil {
+		fmt.Println("pipe failed:", err)
+	}
+
+	//去重，精确模式只记住最近的 2 个元素，概率模式使用 Bloom filter
+	repeated := []int{1, 2, 1, 3, 1, 2, 2}
+	for n := range pipeline(repeated, echo, DistinctPipe(RememberLast(2))) {
+		fmt.Println(n)
+	}
+	for n := range pipeline(repeated, echo, DistinctPipe(Bloom(1000, 0.01))) {
+		fmt.Println(n)
+	}
+
+	//按订单号连接订单和支付记录，没有支付的订单和找不到订单的支付也会输出
+	type order struct {
+		id   int
+		item string
+	}
+	type payment struct {
+		orderID int
+		amount  int
+	}
+	orders := From(FromSlice([]order{{1, "book"}, {2, "pen"}, {3, "cup"}}))
+	payments := From(FromSlice([]payment{{1, 30}, {3, 12}, {4, 9}}))
+	joined, h := Join(orders, payments,
+		func(o order) int { return o.id },
+		func(p payment) int { return p.orderID },
+		JoinWithin(time.Minute), LeftOuter(), RightOuter(),
+	).Run(context.Background())
+	for j := range joined {
+		switch j.Side {
+		case Matched:
+			fmt.Printf("order %d: %s paid %d\n", j.Key, j.Left.item, j.Right.amount)
+		case LeftOnly:
+			fmt.Printf("order %d: %s not paid\n", j.Key, j.Left.item)
+		case RightOnly:
+			fmt.Printf("order %d: unknown order paid %d\n", j.Key, j.Right.amount)
+		}
+	}
+	h.Wait()
+
+	//输出 pipeline 的拓扑结构，可以用 dot -Tsvg 渲染为图片
+	topoMetrics := NewMetrics()
+	DescribePipeline(echo, ParallelPipe(4, square, Ordered), InstrumentPipe(topoMetrics, "odd", odd), sum).WriteDOT(os.Stdout, nil)
+	topoBranches := Broadcast(From(NamedSource("nums", FromSlice(nums))), 2)
+	squares := topoBranches[0].Pipe(Instrument(topoMetrics, "square", Parallel(4, ctxSquare, Ordered)))
+	odds := topoBranches[1].Pipe(Named("odd", FilterStage(func(n int) bool { return n%2 == 1 })))
+	topoOut, h := MergeFlows(squares, odds).Pipe(ctxSum).Run(context.Background())
+	fmt.Println(<-topoOut)
+	h.Wait()
+	h.Topology().WriteDOT(os.Stdout, topoMetrics)
+
+	//按时间戳归并多个已经有序的日志
+	logA := strings.NewReader("10:00:01 a start\n10:00:05 a done\n")
+	logB := strings.NewReader("10:00:02 b start\n10:00:03 b retry\n10:00:09 b done\n")
+	byTime := func(x, y string) int {
+		tx, _, _ := strings.Cut(x, " ")
+		ty, _, _ := strings.Cut(y, " ")
+		return strings.Compare(tx, ty)
+	}
+	logs, h := From(MergeSortedSources(byTime, ReaderLines(logA), ReaderLines(logB))).Run(context.Background())
+	for line := range logs {
+		fmt.Println(line)
+	}
+	h.Wait()
+
+	//处理超过 10ms 的元素被丢弃
+	slow := func(ctx context.Context, n int) (int, error) {
+		d := time.Millisecond
+		if n == 3 {
+			d = time.Second
+		}
+		select {
+		case <-time.After(d):
+			return n * n, nil
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	timely, h := Then(From(FromSlice(nums)), TimeoutMap(10*time.Millisecond, slow, DropOnTimeout)).Run(context.Background())
+	for n := range timely {
+		fmt.Println(n)
+	}
+	h.Wait()
+
+	//快速到达的一串元素，Throttle 只保留第一个，Debounce 只保留最后一个
+	first, h := From(FromSlice(nums)).Pipe(Throttle[int](time.Second)).Run(context.Background())
+	fmt.Println(<-first)
+	h.Wait()
+	last, h := From(FromSlice(nums)).Pipe(Debounce[int](time.Second)).Run(context.Background())
+	fmt.Println(<-last)
+	h.Wait()
+
+	//限流为每秒 100 个，允许连续通过 3 个，记录每个元素等待的时间
+	var waits RateStats
+	for n := range pipeline(nums, echo, RateLimitPipe(100, Burst(3), RecordWaits(&waits)), square) {
+		fmt.Println(n)
+	}
+	ws := waits.Snapshot()
+	fmt.Printf("delayed %d/%d items, max wait %v\n", ws.Delayed, ws.Count, ws.Max.Round(time.Millisecond))
+
+	//处理较慢的 stage 根据排队的元素个数自动增加 worker
+	slowSquare := func(n int) int {
+		time.Sleep(5 * time.Millisecond)
+		return n * n
+	}
+	logScale := OnScale(func(d ScaleDecision) {
+		fmt.Printf("workers %d -> %d: %s, backlog=%d utilization=%.2f\n", d.From, d.To, d.Reason, d.Backlog, d.Utilization)
+	})
+	many := make([]int, 200)
+	for i := range many {
+		many[i] = i
+	}
+	for n := range pipeline(many, echo, AutoscalePipe(slowSquare, Workers(1, 4), ScaleEvery(20*time.Millisecond), logScale), sum) {
+		fmt.Println(n)
+	}
+
+	//square 和 sum 之间使用落盘的队列，内存中只缓冲 2 个元素，其余的写入 segment 文件
+	spill, err := OpenSpillQueue[int](filepath.Join(dir, "spill"), MemoryItems(2), SegmentSize(64))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for n := range pipeline(many, echo, square, SpillPipe(spill), sum) {
+		fmt.Println(n)
+	}
+	fmt.Println("spilled bytes left:", spill.DiskBytes())
+
+	//数据源不会结束，暂停一段时间后恢复，再排空：已经产生的元素都会计入 sum
+	next := 0
+	endless := Generate(func() (int, bool) {
+		next++
+		time.Sleep(time.Millisecond)
+		return next, true
+	})
+	out, h = From(endless).Pipe(ctxSquare, ctxSum).Run(context.Background())
+	time.Sleep(20 * time.Millisecond)
+	h.Pause()
+	time.Sleep(10 * time.Millisecond)
+	paused := h.Status()
+	fmt.Printf("%v: emitted %d, goroutines %d\n", paused.State, paused.Emitted, paused.Goroutines)
+	h.Resume()
+	time.Sleep(20 * time.Millisecond)
+	drained := make(chan error, 1)
+	go func() {
+		drained <- h.Drain()
+	}()
+	for n := range out {
+		fmt.Println("sum:", n)
+	}
+	if err := <-drained; err != nil {
+		log.Fatal(err)
+	}
+	final := h.Status()
+	fmt.Printf("%v: emitted %d, goroutines %d\n", final.State, final.Emitted, final.Goroutines)
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//自动伸缩的并行 stage
+//Parallel 的 worker 个数是固定的，Autoscale 每隔一段时间根据排队的元素个数和 worker 的忙碌程度调整 worker 的个数：
+//	排队的元素不少于 worker 的个数，或者 worker 几乎一直在忙并且有元素在排队时，增加一个 worker
+//	没有排队的元素，并且 worker 一半以上的时间都空闲时，减少一个 worker
+//每次调整都可以通过 OnScale 观察到，输出的顺序和 Parallel 的 Unordered 模式一样是不确定的
+
+type scaleConfig struct {
+	min, max int
+	interval time.Duration
+	onScale  func(ScaleDecision)
+}
+
+type ScaleOption func(*scaleConfig)
+
+//worker 个数的范围 [lo, hi]，开始时有 lo 个 worker，默认为 [1, 8]
+func Workers(lo, hi int) ScaleOption {
+	return func(c *scaleConfig) {
+		c.min = max(lo, 1)
+		c.max = max(hi, c.min)
+	}
+}
+
+//每隔 d 检查一次是否需要调整，默认 100ms，最小为 minWindow
+func ScaleEvery(d time.Duration) ScaleOption {
+	return func(c *scaleConfig) {
+		c.interval = max(d, minWindow)
+	}
+}
+
+//每次调整 worker 个数之后调用 fn
+func OnScale(fn func(ScaleDecision)) ScaleOption {
+	return func(c *scaleConfig) {
+		c.onScale = fn
+	}
+}
+
+//一次调整，以及做出调整时的依据
+type ScaleDecision struct {
+	At          time.Time
+	From, To    int
+	Backlog     int           //排队的元素个数
+	Utilization float64       //上一段时间内 worker 忙碌的时间占比
+	AvgLatency  time.Duration //上一段时间内处理一个元素的平均耗时
+	Reason      string        //backlog、busy 或者 idle
+}
+
+//用自动伸缩的一组 worker 处理每个元素
+func Autoscale[A, B any](fn func(A) B, opts ...ScaleOption) Stage[A, B] {
+	cfg := scaleConfig{min: 1, max: 8, interval: 100 * time.Millisecond}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	return func(ctx context.Context, in <-chan A) <-chan B {
+		out := make(chan B)
+		//排队的元素，它的长度就是 backlog
+		jobs := make(chan A, cfg.max)
+		//每发送一次，一个 worker 退出
+		quit := make(chan struct{})
+		clock := clockFrom(ctx)
+
+		var busy, processed atomic.Int64
+		var wg sync.WaitGroup
+		worker := func() {
+			defer wg.Done()
+			for {
+				select {
+				case v, ok := <-jobs:
+					if !ok {
+						return
+					}
+					begin := clock.Now()
+					res := fn(v)
+					busy.Add(int64(clock.Now().Sub(begin)))
+					processed.Add(1)
+					if !send(ctx, out, res) {
+						return
+					}
+				case <-quit:
+					return
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+
+		dispatched := make(chan struct{})
+		goStage(ctx, func() {
+			defer close(dispatched)
+			defer close(jobs)
+			for v := range in {
+				if !send(ctx, jobs, v) {
+					return
+				}
+			}
+		})
+
+		//只有这个 goroutine 启动和停止 worker
+		goStage(ctx, func() {
+			defer close(out)
+			workers := 0
+			for ; workers < cfg.min; workers++ {
+				wg.Add(1)
+				goStage(ctx, worker)
+			}
+
+			ticker := clock.NewTicker(cfg.interval)
+			defer ticker.Stop()
+			last := clock.Now()
+			for {
+				select {
+				case now := <-ticker.C():
+					elapsed := now.Sub(last)
+					last = now
+					n, b := processed.Swap(0), time.Duration(busy.Swap(0))
+					d := ScaleDecision{At: now, From: workers, To: workers, Backlog: len(jobs)}
+					if elapsed > 0 {
+						d.Utilization = float64(b) / float64(time.Duration(workers)*elapsed)
+					}
+					if n > 0 {
+						d.AvgLatency = b / time.Duration(n)
+					}
+
+					switch {
+					case workers < cfg.max && d.Backlog >= workers:
+						d.To, d.Reason = workers+1, "backlog"
+					case workers < cfg.max && d.Backlog > 0 && d.Utilization >= 0.9:
+						d.To, d.Reason = workers+1, "busy"
+					case workers > cfg.min && d.Backlog == 0 && d.Utilization < 0.5:
+						d.To, d.Reason = workers-1, "idle"
+					default:
+						continue
+					}
+
+					if d.To > workers {
+						wg.Add(1)
+						goStage(ctx, worker)
+					} else {
+						//输入结束之后 worker 处理完剩下的元素就会退出，可能已经没有 worker 接收 quit 了
+						select {
+						case quit <- struct{}{}:
+						case <-dispatched:
+							wg.Wait()
+							return
+						case <-ctx.Done():
+						}
+					}
+					workers = d.To
+					if cfg.onScale != nil {
+						cfg.onScale(d)
+					}
+				case <-dispatched:
+					//输入已经结束，不再调整，等待剩下的 worker 处理完
+					wg.Wait()
+					return
+				case <-ctx.Done():
+					wg.Wait()
+					return
+				}
+			}
+		})
+		return out
+	}
+}
+
+//	pipeline(nums, echo, AutoscalePipe(slowSquare, Workers(1, 16)), sum)
+func AutoscalePipe(fn func(int) int, opts ...ScaleOption) PipeFunc {
+	return asPipeFunc(Autoscale(fn, opts...))
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//Checkpoint 和可恢复的 Pipeline
+//Resume 为数据源的每个元素编上 offset，元素以 Record 的形式在 pipeline 中流动，
+//CheckpointSink 把结果写入并 flush 之后，定期把已经写入的 offset 和有状态 stage 的状态提交到本地文件
+//进程崩溃后重新运行，数据源从最后一次提交的 offset 开始重放，因此 sink 至少会收到一次所有的结果
+//
+//要求：
+//1.数据源可以重放，例如切片、文件
+//2.pipeline 保持元素的顺序，sink 收到 offset 为 k 的结果时，k 之前的元素都已经处理完成
+
+//带有数据源 offset 的元素
+type Record[T any] struct {
+	Offset int64
+	Value  T
+}
+
+type checkpointFile struct {
+	Offset int64                      `json:"offset"`
+	State  map[string]json.RawMessage `json:"state,omitempty"`
+}
+
+//Checkpointer 把 pipeline 的进度保存在本地文件中
+type Checkpointer struct {
+	path     string
+	interval time.Duration
+
+	mu     sync.Mutex
+	saved  checkpointFile
+	stages map[string]func(offset int64) any
+}
+
+//打开 path 中保存的 checkpoint，文件不存在时从头开始，interval 是两次提交之间的最小间隔
+func OpenCheckpoint(path string, interval time.Duration) (*Checkpointer, error) {
+	c := &Checkpointer{path: path, interval: interval, stages: make(map[string]func(int64) any)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.saved); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//最后一次提交的 offset，也就是恢复时数据源的起点
+func (c *Checkpointer) Offset() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.saved.Offset
+}
+
+//读取名为 name 的 stage 保存的状态，没有保存过时返回 false
+func (c *Checkpointer) loadState(name string, v any) (bool, error) {
+	c.mu.Lock()
+	raw, ok := c.saved.State[name]
+	c.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+//注册一个有状态的 stage，提交时通过 snapshot 取得它处理完 offset 之前所有元素时的状态
+func (c *Checkpointer) register(name string, snapshot func(offset int64) any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stages[name] = snapshot
+}
+
+//提交 offset，offset 之前的元素都已经写入 sink
+//先写入临时文件再重命名，保证 checkpoint 文件总是完整的
+func (c *Checkpointer) commit(offset int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	next := checkpointFile{Offset: offset, State: make(map[string]json.RawMessage)}
+	for name, snapshot := range c.stages {
+		raw, err := json.Marshal(snapshot(offset))
+		if err != nil {
+			return err
+		}
+		next.State[name] = raw
+	}
+	data, err := json.Marshal(next)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return err
+	}
+	c.saved = next
+	return nil
+}
+
+//为数据源的元素编上 offset，并跳过已经提交的部分
+func Resume[T any](c *Checkpointer, src Source[T]) Source[Record[T]] {
+	return func(ctx context.Context) <-chan Record[T] {
+		start := c.Offset()
+		in := src(ctx)
+		out := make(chan Record[T])
+		goStage(ctx, func() {
+			defer close(out)
+			var offset int64
+			for v := range in {
+				if offset >= start && !send(ctx, out, Record[T]{offset, v}) {
+					return
+				}
+				offset++
+			}
+		})
+		return out
+	}
+}
+
+//让一个普通的 stage 处理 Record，输出的结果带上输入元素的 offset
+//每个元素单独经过一次 stage，所以 stage 必须独立地处理每个元素
+func Lift[A, B any](stage Stage[A, B]) Stage[Record[A], Record[B]] {
+	return func(ctx context.Context, in <-chan Record[A]) <-chan Record[B] {
+		out := make(chan Record[B])
+		goStage(ctx, func() {
+			defer close(out)
+			for rec := range in {
+				one := make(chan A, 1)
+				one <- rec.Value
+				close(one)
+				for v := range stage(ctx, one) {
+					if !send(ctx, out, Record[B]{rec.Offset, v}) {
+						return
+					}
+				}
+			}
+		})
+		return out
+	}
+}
+
+type scanState[R any] struct {
+	offset int64
+	acc    R
+}
+
+//可恢复的累积 stage，每个元素输出一次当前的累积结果，例如不断更新的总和
+//累积结果作为 name 的状态保存在 checkpoint 中，恢复时从保存的状态继续累积
+func ResumableScan[T, R any](c *Checkpointer, name string, zero R, fn func(R, T) R) Stage[Record[T], Record[R]] {
+	return func(ctx context.Context, in <-chan Record[T]) <-chan Record[R] {
+		acc := zero
+		if _, err := c.loadState(name, &acc); err != nil {
+			ReportError(ctx, err)
+		}
+
+		//提交之前处理过的每个元素之后的状态，提交时从中找到对应 offset 的状态
+		var mu sync.Mutex
+		history := []scanState[R]{{c.Offset() - 1, acc}}
+		c.register(name, func(offset int64) any {
+			mu.Lock()
+			defer mu.Unlock()
+			i := 0
+			for i+1 < len(history) && history[i+1].offset < offset {
+				i++
+			}
+			history = history[i:]
+			return history[0].acc
+		})
+
+		out := make(chan Record[R])
+		goStage(ctx, func() {
+			defer close(out)
+			for rec := range in {
+				acc = fn(acc, rec.Value)
+				mu.Lock()
+				history = append(history, scanState[R]{rec.Offset, acc})
+				mu.Unlock()
+				if !send(ctx, out, Record[R]{rec.Offset, acc}) {
+					return
+				}
+			}
+		})
+		return out
+	}
+}
+
+//按照 format 把结果写入 w，每隔一段时间 flush 并提交已经写入的 offset
+//恢复运行时 w 应该以追加的方式打开，最后一次提交之后写入的结果会重复出现
+func CheckpointSink[T any](c *Checkpointer, w io.Writer, format Format[T]) Sink[Record[T]] {
+	return func(in <-chan Record[T]) (int, error) {
+		write, flush := format(w)
+		n := 0
+		last := time.Now()
+		next := int64(-1)
+		commit := func() error {
+			if next < 0 {
+				return nil
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+			return c.commit(next)
+		}
+
+		for rec := range in {
+			if err := write(rec.Value); err != nil {
+				return n, err
+			}
+			n++
+			next = rec.Offset + 1
+			if time.Since(last) >= c.interval {
+				if err := commit(); err != nil {
+					return n, err
+				}
+				last = time.Now()
+			}
+		}
+		if err := flush(); err != nil {
+			return n, err
+		}
+		return n, commit()
+	}
+}
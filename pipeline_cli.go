@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+//命令行形式的 Pipeline
+//像 shell 一样用 | 连接 Registry 中的 stage，例如：
+//	go run pipeline*.go 'echo 1..100 | square | odd | sum'
+//	seq 100 | go run pipeline*.go 'square | sum'
+//第一段不是数据源时，从标准输入逐行读取整数
+//参数可以按位置传入，也可以写成 name=value，最后一个参数会收集剩余的所有位置参数
+//数据源 echo a..b 表示一个范围，使用 range 数据源逐个产生，不会先展开为列表
+
+//解析 a..b，ok 为 false 表示 s 不是范围
+func parsePipeRange(s string) (from, to int, ok bool, err error) {
+	a, b, ok := strings.Cut(s, "..")
+	if !ok {
+		return 0, 0, false, nil
+	}
+	from, err1 := strconv.Atoi(a)
+	to, err2 := strconv.Atoi(b)
+	if err1 != nil || err2 != nil {
+		return 0, 0, true, fmt.Errorf("bad range %q", s)
+	}
+	return from, to, true, nil
+}
+
+//解析一个参数
+func parsePipeArg(s string) (any, error) {
+	if _, _, ok, err := parsePipeRange(s); ok {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("range %q is only supported as the source, e.g. echo %s", s, s)
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		return n, nil
+	}
+	return s, nil
+}
+
+//把一段表达式的参数转换为 Params，names 是这个 stage 接受的参数名
+func parsePipeParams(args []string, names []string) (Params, error) {
+	params := Params{}
+	var positional []any
+	for _, arg := range args {
+		if key, value, ok := strings.Cut(arg, "="); ok {
+			v, err := parsePipeArg(value)
+			if err != nil {
+				return nil, err
+			}
+			params[key] = v
+			continue
+		}
+		v, err := parsePipeArg(arg)
+		if err != nil {
+			return nil, err
+		}
+		positional = append(positional, v)
+	}
+
+	if len(positional) > 0 && len(names) == 0 {
+		return nil, fmt.Errorf("does not accept arguments")
+	}
+	for i, v := range positional {
+		if i < len(names)-1 {
+			params[names[i]] = v
+			continue
+		}
+
+		//最后一个参数收集剩余的位置参数
+		rest := positional[i:]
+		last := names[len(names)-1]
+		if len(rest) == 1 {
+			params[last] = v
+			break
+		}
+		params[last] = rest
+		break
+	}
+	if len(params) == 0 {
+		return nil, nil
+	}
+	return params, nil
+}
+
+//把 "echo 1..100 | square | odd | sum" 解析为 PipelineDef
+//第一段不是 r 中的数据源时，使用名为 stdin 的数据源，r 为 nil 时使用 NewRegistry()
+func ParsePipeExpr(r *Registry, expr string) (*PipelineDef, error) {
+	if r == nil {
+		r = NewRegistry()
+	}
+	def := &PipelineDef{Source: StageDef{Name: "stdin"}}
+	for i, segment := range strings.Split(expr, "|") {
+		fields := strings.Fields(segment)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("segment %d: empty stage", i+1)
+		}
+		name, args := fields[0], fields[1:]
+
+		if i == 0 {
+			//echo a..b 和 range a..b 使用 range 数据源
+			if len(args) == 1 && (name == "echo" || name == "range") {
+				from, to, ok, err := parsePipeRange(args[0])
+				if err != nil {
+					return nil, fmt.Errorf("segment %d: %s: %w", i+1, name, err)
+				}
+				if ok {
+					def.Source = StageDef{"range", Params{"from": from, "to": to}}
+					continue
+				}
+			}
+			if src, ok := r.sources[name]; ok {
+				params, err := parsePipeParams(args, src.params)
+				if err != nil {
+					return nil, fmt.Errorf("segment %d: %s: %w", i+1, name, err)
+				}
+				def.Source = StageDef{name, params}
+				continue
+			}
+		}
+
+		stage, ok := r.stages[name]
+		if !ok {
+			return nil, fmt.Errorf("segment %d: unknown stage %q", i+1, name)
+		}
+		params, err := parsePipeParams(args, stage.params)
+		if err != nil {
+			return nil, fmt.Errorf("segment %d: %s: %w", i+1, name, err)
+		}
+		def.Stages = append(def.Stages, StageDef{name, params})
+	}
+	return def, nil
+}
+
+//运行一个管道表达式，结果逐行写入 stdout，每个 stage 的错误写入 stderr
+//r 为 nil 时使用 NewRegistry，stdin 数据源从 stdin 中逐行读取整数，它注册在 r 的副本中，不会修改 r
+func RunPipeExpr(r *Registry, expr string, stdin io.Reader, stdout, stderr io.Writer) error {
+	if r == nil {
+		r = NewRegistry()
+	} else {
+		r = r.clone()
+	}
+	r.RegisterSource("stdin", func(Params) (Source[int], error) {
+		return Then(From(ReaderLines(stdin)), TryMap(func(line string) (int, error) {
+			return strconv.Atoi(strings.TrimSpace(line))
+		})).Source(), nil
+	})
+
+	def, err := ParsePipeExpr(r, expr)
+	if err != nil {
+		fmt.Fprintln(stderr, "pipeline:", err)
+		return err
+	}
+	flow, err := r.Build(def)
+	if err != nil {
+		fmt.Fprintln(stderr, "pipeline:", err)
+		return err
+	}
+
+	out, h := flow.Run(context.Background())
+	if _, err := LinesSink[int](stdout)(out); err != nil {
+		h.Stop()
+		fmt.Fprintln(stderr, "pipeline:", err)
+		return err
+	}
+	h.Wait()
+	for _, err := range h.Errors() {
+		fmt.Fprintln(stderr, "pipeline:", err)
+	}
+	return h.Err()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+//Pipeline 使用的时钟
+//和时间相关的 stage 都通过 ctx 中的 Clock 读取时间、创建定时器，
+//默认使用真实的时间，测试时可以通过 WithClock 换成 FakeClock，见 helpers_test.go
+
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Timer
+	NewTimer(d time.Duration) Timer
+}
+
+//Ticker 和 Timer 共同的部分
+type Timer interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Timer {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTicker) Stop() {
+	t.t.Stop()
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTimer) Stop() {
+	t.t.Stop()
+}
+
+type clockKey struct{}
+
+//让 ctx 中运行的 pipeline 使用 clock
+func WithClock(ctx context.Context, clock Clock) context.Context {
+	return context.WithValue(ctx, clockKey{}, clock)
+}
+
+func clockFrom(ctx context.Context) Clock {
+	if clock, ok := ctx.Value(clockKey{}).(Clock); ok {
+		return clock
+	}
+	return realClock{}
+}
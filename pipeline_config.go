@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+//声明式的 Pipeline
+//把 stage 以名字注册到 Registry 中，pipeline 的结构写在 JSON 或 YAML 文件里，
+//加载时校验名字和参数，然后构建为可以运行的 Flow，修改流程不需要重新编译
+//
+//	source:
+//	  name: range
+//	  params: {from: 1, to: 100}
+//	stages:
+//	  - name: square
+//	  - name: odd
+//	  - name: sum
+
+//stage 的参数，来自 JSON 或 YAML
+type Params map[string]any
+
+func (p Params) Int(key string, def int) (int, error) {
+	v, ok := p[key]
+	if !ok {
+		return def, nil
+	}
+	return toInt(key, v)
+}
+
+func (p Params) Ints(key string) ([]int, error) {
+	v, ok := p[key]
+	if !ok {
+		return nil, nil
+	}
+	list, ok := v.([]any)
+	if !ok {
+		//单个数字当作只有一个元素的列表，JSON 和 YAML 中的 nums: 5 与命令行中的 echo 5 一致
+		n, err := toInt(key, v)
+		if err != nil {
+			return nil, fmt.Errorf("param %q: want a list of integers, got %v", key, v)
+		}
+		return []int{n}, nil
+	}
+	res := make([]int, len(list))
+	for i, item := range list {
+		n, err := toInt(key, item)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = n
+	}
+	return res, nil
+}
+
+func (p Params) String(key, def string) (string, error) {
+	v, ok := p[key]
+	if !ok {
+		return def, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("param %q: want a string, got %v", key, v)
+	}
+	return s, nil
+}
+
+func toInt(key string, v any) (int, error) {
+	switch n := v.(type) {
+	case int:
+		return n, nil
+	case float64:
+		//JSON 中的数字都会被解析为 float64
+		if n == math.Trunc(n) {
+			return int(n), nil
+		}
+	}
+	return 0, fmt.Errorf("param %q: want an integer, got %v", key, v)
+}
+
+type StageFactory func(p Params) (Stage[int, int], error)
+type SourceFactory func(p Params) (Source[int], error)
+
+type registryEntry[F any] struct {
+	factory F
+	//允许的参数名，按照位置参数的顺序排列
+	params []string
+}
+
+//名字到 stage 和数据源的映射
+type Registry struct {
+	stages  map[string]registryEntry[StageFactory]
+	sources map[string]registryEntry[SourceFactory]
+}
+
+//创建一个包含内置 stage 的 Registry
+//数据源：echo(nums)、range(from, to)
+//stage：square、odd、sum、window_sum(size, step)
+func NewRegistry() *Registry {
+	r := &Registry{
+		stages:  make(map[string]registryEntry[StageFactory]),
+		sources: make(map[string]registryEntry[SourceFactory]),
+	}
+
+	r.RegisterSource("echo", func(p Params) (Source[int], error) {
+		nums, err := p.Ints("nums")
+		if err != nil {
+			return nil, err
+		}
+		return FromEcho(ctxEcho, nums), nil
+	}, "nums")
+	r.RegisterSource("range", func(p Params) (Source[int], error) {
+		from, err := p.Int("from", 1)
+		if err != nil {
+			return nil, err
+		}
+		to, err := p.Int("to", from)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context) <-chan int {
+			n := from
+			return Generate(func() (int, bool) {
+				v := n
+				n++
+				return v, v <= to
+			})(ctx)
+		}, nil
+	}, "from", "to")
+
+	r.RegisterStage("square", func(Params) (Stage[int, int], error) { return ctxSquare, nil })
+	r.RegisterStage("odd", func(Params) (Stage[int, int], error) { return ctxOdd, nil })
+	r.RegisterStage("sum", func(Params) (Stage[int, int], error) { return ctxSum, nil })
+	r.RegisterStage("window_sum", func(p Params) (Stage[int, int], error) {
+		size, err := p.Int("size", 0)
+		if err != nil {
+			return nil, err
+		}
+		if size < 1 {
+			return nil, fmt.Errorf("param \"size\": must be positive")
+		}
+		step, err := p.Int("step", size)
+		if err != nil {
+			return nil, err
+		}
+		return SlidingCount(size, step, 0, func(acc, n int) int { return acc + n }), nil
+	}, "size", "step")
+	return r
+}
+
+//注册一个 stage，params 是它接受的参数名
+func (r *Registry) RegisterStage(name string, factory StageFactory, params ...string) {
+	r.stages[name] = registryEntry[StageFactory]{factory, params}
+}
+
+//注册一个数据源，params 是它接受的参数名
+func (r *Registry) RegisterSource(name string, factory SourceFactory, params ...string) {
+	r.sources[name] = registryEntry[SourceFactory]{factory, params}
+}
+
+//复制一个 Registry，在副本中注册不会影响原来的 Registry
+func (r *Registry) clone() *Registry {
+	return &Registry{stages: maps.Clone(r.stages), sources: maps.Clone(r.sources)}
+}
+
+type StageDef struct {
+	Name   string `json:"name"`
+	Params Params `json:"params,omitempty"`
+}
+
+type PipelineDef struct {
+	Source StageDef   `json:"source"`
+	Stages []StageDef `json:"stages"`
+}
+
+//从文件中加载 pipeline 的定义，根据扩展名判断是 JSON 还是 YAML
+func LoadPipelineDef(path string) (*PipelineDef, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch filepath.Ext(path) {
+	case ".json":
+		return ParsePipelineDef(data)
+	case ".yaml", ".yml":
+		return ParsePipelineDefYAML(data)
+	}
+	return nil, fmt.Errorf("%s: unknown pipeline definition format", path)
+}
+
+//不认识的字段是错误，例如把 stages 写成了 stage
+func ParsePipelineDef(data []byte) (*PipelineDef, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var def PipelineDef
+	if err := dec.Decode(&def); err != nil {
+		return nil, err
+	}
+	return &def, nil
+}
+
+//YAML 先解析为和 JSON 相同的结构，再按照 JSON 的方式解码
+func ParsePipelineDefYAML(data []byte) (*PipelineDef, error) {
+	v, err := parseYAML(string(data))
+	if err != nil {
+		return nil, err
+	}
+	data, err = json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePipelineDef(data)
+}
+
+func checkParams(where, name string, p Params, allowed []string) error {
+	var unknown []string
+	for key := range p {
+		found := false
+		for _, a := range allowed {
+			if a == key {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("%s: %s does not accept params %q", where, name, unknown)
+	}
+	return nil
+}
+
+//校验定义并构建 Flow，错误信息中带有出错的位置
+func (r *Registry) Build(def *PipelineDef) (*Flow[int], error) {
+	src, ok := r.sources[def.Source.Name]
+	if !ok {
+		return nil, fmt.Errorf("source: unknown source %q", def.Source.Name)
+	}
+	if err := checkParams("source", def.Source.Name, def.Source.Params, src.params); err != nil {
+		return nil, err
+	}
+	source, err := src.factory(def.Source.Params)
+	if err != nil {
+		return nil, fmt.Errorf("source: %s: %w", def.Source.Name, err)
+	}
+
+	stages := make([]Stage[int, int], len(def.Stages))
+	for i, sd := range def.Stages {
+		where := fmt.Sprintf("stages[%d]", i)
+		entry, ok := r.stages[sd.Name]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown stage %q", where, sd.Name)
+		}
+		if err := checkParams(where, sd.Name, sd.Params, entry.params); err != nil {
+			return nil, err
+		}
+		stage, err := entry.factory(sd.Params)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", where, sd.Name, err)
+		}
+		stages[i] = Named(sd.Name, stage)
+	}
+	return From(NamedSource(def.Source.Name, source)).Pipe(stages...), nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+//带 context 的 Pipeline
+//pipeline.go 中的 stage 在 consumer 提前退出时会一直阻塞在 out <- n 上，造成 goroutine 泄漏
+//这里的每个 stage 都会监听 ctx，取消后立即退出并关闭自己的 out
+
+//一次 pipeline 运行的状态，记录了所有 stage 启动的 goroutine 和 stage 报告的错误
+type runState struct {
+	wg     sync.WaitGroup
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	errs []error
+	//同一个节点在一次运行中只构建一次，例如被多个分支共享的上游
+	built map[any]*builtNode
+
+	//构建时记录的拓扑结构，describe 为 true 时只构建不运行，见 pipeline_topology.go
+	topo     *topoRecorder
+	describe bool
+
+	//数据源的闸门和还在运行的 goroutine 个数，见 pipeline_control.go
+	gate *runGate
+	live atomic.Int64
+
+	//live 减为 0 时调用，原始 pipeline 用它清理 channel 和运行状态的对应关系，见 pipeline_panic.go
+	onIdle func()
+}
+
+type runStateKey struct{}
+
+func withRunState(ctx context.Context) (context.Context, *runState) {
+	ctx, cancel := context.WithCancel(ctx)
+	rs := &runState{cancel: cancel, topo: &topoRecorder{byChan: make(map[any]int)}, gate: newRunGate()}
+	return context.WithValue(ctx, runStateKey{}, rs), rs
+}
+
+func getRunState(ctx context.Context) *runState {
+	rs, _ := ctx.Value(runStateKey{}).(*runState)
+	return rs
+}
+
+//启动一个 stage 的 goroutine，并登记到当前的运行状态中，便于等待其退出
+//goroutine 中的 panic 会被转换为错误，见 pipeline_panic.go
+func goStage(ctx context.Context, fn func()) {
+	rs := getRunState(ctx)
+	if rs != nil {
+		if rs.describe {
+			return
+		}
+		rs.wg.Add(1)
+		rs.live.Add(1)
+	}
+	pc, _, _, _ := runtime.Caller(1)
+	go func() {
+		if rs != nil {
+			defer rs.wg.Done()
+			defer rs.release()
+		}
+		defer recoverStage(ctx, pc)
+		fn()
+	}()
+}
+
+//一个 goroutine 退出
+func (rs *runState) release() {
+	if rs.live.Add(-1) == 0 && rs.onIdle != nil {
+		rs.onIdle()
+	}
+}
+
+//向 out 发送一个值，如果 ctx 已经取消则放弃发送并返回 false
+//Drain 取消数据源的 ctx 时例外，已经产生的元素仍然会发送，见 pipeline_control.go
+func send[T any](ctx context.Context, out chan<- T, v T) bool {
+	select {
+	case out <- v:
+		return true
+	case <-ctx.Done():
+		return sendDrained(ctx, out, v)
+	}
+}
+
+type CtxEchoFunc func(ctx context.Context, nums []int) <-chan int
+type CtxPipeFunc func(ctx context.Context, in <-chan int) <-chan int
+
+func ctxEcho(ctx context.Context, nums []int) <-chan int {
+	out := make(chan int)
+	goStage(ctx, func() {
+		defer close(out)
+		for _, n := range nums {
+			if !send(ctx, out, n) {
+				return
+			}
+		}
+	})
+
+	return out
+}
+
+func ctxSquare(ctx context.Context, in <-chan int) <-chan int {
+	out := make(chan int)
+	goStage(ctx, func() {
+		defer close(out)
+		for n := range in {
+			if !send(ctx, out, n*n) {
+				return
+			}
+		}
+	})
+
+	return out
+}
+
+//和 odd 保持一致，输出奇数的平方
+func ctxOdd(ctx context.Context, in <-chan int) <-chan int {
+	out := make(chan int)
+	goStage(ctx, func() {
+		defer close(out)
+		for n := range in {
+			if n%2 == 1 && !send(ctx, out, n*n) {
+				return
+			}
+		}
+	})
+
+	return out
+}
+
+func ctxSum(ctx context.Context, in <-chan int) <-chan int {
+	out := make(chan int)
+	goStage(ctx, func() {
+		defer close(out)
+		sum := 0
+		for n := range in {
+			sum += n
+		}
+		//被取消时上游提前关闭，此时的结果是不完整的，不能输出
+		if ctx.Err() != nil {
+			return
+		}
+		send(ctx, out, sum)
+	})
+
+	return out
+}
+
+//Handle 用于控制一个已经启动的 pipeline
+type Handle struct {
+	state *runState
+}
+
+//取消 pipeline，并等待所有 stage 的 goroutine 退出
+func (h *Handle) Stop() error {
+	h.state.cancel()
+	return h.Wait()
+}
+
+//等待所有 stage 的 goroutine 退出，所有的 channel 此时都已关闭
+//返回 stage 报告的第一个错误
+func (h *Handle) Wait() error {
+	h.state.wg.Wait()
+	h.state.cancel()
+	return h.Err()
+}
+
+func pipelineWithContext(ctx context.Context, nums []int, echoFunc CtxEchoFunc, pipeFunc ...CtxPipeFunc) (<-chan int, *Handle) {
+	stages := make([]Stage[int, int], len(pipeFunc))
+	for i := range pipeFunc {
+		stages[i] = Stage[int, int](pipeFunc[i])
+	}
+	return From(FromEcho(echoFunc, nums)).Pipe(stages...).Run(ctx)
+}
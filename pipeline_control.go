@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+//控制运行中的 Pipeline
+//From 在每个数据源后面加一道闸门，Handle 通过闸门控制所有的数据源：
+//	Pause：数据源暂停产生新的元素，已经在 pipeline 中的元素继续处理
+//	Resume：恢复暂停的数据源
+//	Drain：数据源不再产生新的元素，已经产生的元素处理完之后正常结束
+//	Status：pipeline 当前的状态
+//和 Stop 不同，Drain 只取消数据源的 ctx，不会取消 stage，聚合类的 stage 会输出已经处理的元素的结果
+//数据源被取消时可能正在发送一个已经产生的元素，send 会等到闸门接收之后才让数据源退出，这个元素不会丢失
+//注意：嵌套的 Flow 作为数据源时，其中的 stage 也使用数据源的 ctx，直接监听 ctx.Done 的 stage（例如 Sample）
+//会在 Drain 时提前退出，它上游还没有处理的元素会被丢弃
+
+type PipelineState int
+
+const (
+	Running PipelineState = iota
+	Paused
+	Draining
+	//所有 stage 的 goroutine 都已经退出
+	Finished
+)
+
+func (s PipelineState) String() string {
+	switch s {
+	case Running:
+		return "running"
+	case Paused:
+		return "paused"
+	case Draining:
+		return "draining"
+	case Finished:
+		return "finished"
+	}
+	return "unknown"
+}
+
+type Status struct {
+	State PipelineState
+	//还在运行的 stage goroutine 个数
+	Goroutines int64
+	//数据源已经产生的元素个数
+	Emitted int64
+	//stage 报告的第一个错误
+	Err error
+}
+
+//所有数据源共享的闸门
+type runGate struct {
+	mu       sync.Mutex
+	paused   bool
+	draining bool
+	emitted  int64
+	//状态改变时关闭，然后换成一个新的 channel
+	changed chan struct{}
+}
+
+func newRunGate() *runGate {
+	return &runGate{changed: make(chan struct{})}
+}
+
+func (g *runGate) update(fn func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fn()
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+func (g *runGate) snapshot() (paused, draining bool, changed <-chan struct{}) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused, g.draining, g.changed
+}
+
+//数据源的 ctx 中带有这个 key，说明已经在一道闸门后面了
+type gatedKey struct{}
+
+//一道闸门后面的数据源共享的状态
+type gateScope struct {
+	//不会因为 Drain 而取消的 ctx
+	run context.Context
+	//闸门不再读取数据源时关闭
+	done chan struct{}
+}
+
+//Drain 取消数据源的 ctx 时使用的原因
+var errDrained = errors.New("pipeline drained")
+
+//节点是否是数据源，数据源在 Drain 之后发送完手上的元素就退出，stage 则继续处理到输入关闭
+type sourceNodeKey struct{}
+
+func markNode(ctx context.Context, kind string) context.Context {
+	return context.WithValue(ctx, sourceNodeKey{}, kind == "source")
+}
+
+//send 发现 ctx 已经取消时调用：如果是 Drain 取消的，仍然把 v 交给下游
+//返回 true 表示发送者可以继续，数据源返回 false 然后退出
+func sendDrained[T any](ctx context.Context, out chan<- T, v T) bool {
+	scope, ok := ctx.Value(gatedKey{}).(*gateScope)
+	if !ok || !errors.Is(context.Cause(ctx), errDrained) {
+		return false
+	}
+	select {
+	case out <- v:
+		source, _ := ctx.Value(sourceNodeKey{}).(bool)
+		return !source
+	case <-scope.done:
+		return false
+	case <-scope.run.Done():
+		return false
+	}
+}
+
+//启动数据源，并让它的输出经过闸门
+//Drain 之后取消数据源自己的 ctx，闸门继续读取并转发，直到数据源关闭输出，数据源退出时不会影响后面的 stage
+//嵌套的数据源，例如 From(flow.Source()) 中 flow 自己的 From，已经在外层的闸门后面，不再加闸门，元素只计数一次
+func gateSource[T any](ctx context.Context, src Source[T]) <-chan T {
+	rs := getRunState(ctx)
+	if rs == nil || ctx.Value(gatedKey{}) != nil {
+		return src(ctx)
+	}
+	scope := &gateScope{run: ctx, done: make(chan struct{})}
+	srcCtx, cancel := context.WithCancelCause(ctx)
+	in := src(context.WithValue(srcCtx, gatedKey{}, scope))
+	//嵌套的 Flow 作为数据源时，它的输出连接到当前的 source 节点
+	if id, ok := ctx.Value(topoFrameKey{}).(int); ok {
+		rs.topology().output(id, in, cap(in))
+	}
+	out := make(chan T)
+	goStage(ctx, func() {
+		defer close(scope.done)
+		defer cancel(nil)
+		defer close(out)
+		g := rs.gate
+		for {
+			paused, draining, changed := g.snapshot()
+			//暂停时不从数据源读取，数据源阻塞在发送上
+			var from <-chan T
+			if !paused || draining {
+				from = in
+			}
+			if draining {
+				cancel(errDrained)
+				changed = nil
+			}
+			select {
+			case v, ok := <-from:
+				if !ok {
+					return
+				}
+				g.mu.Lock()
+				g.emitted++
+				g.mu.Unlock()
+				if !send(ctx, out, v) {
+					return
+				}
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+	return out
+}
+
+//暂停所有的数据源
+func (h *Handle) Pause() {
+	h.state.gate.update(func() {
+		h.state.gate.paused = true
+	})
+}
+
+//恢复暂停的数据源
+func (h *Handle) Resume() {
+	h.state.gate.update(func() {
+		h.state.gate.paused = false
+	})
+}
+
+//不再接受新的元素，等待已经在 pipeline 中的元素处理完成，返回 stage 报告的第一个错误
+//下游需要继续读取输出，直到输出关闭
+func (h *Handle) Drain() error {
+	h.state.gate.update(func() {
+		h.state.gate.draining = true
+	})
+	return h.Wait()
+}
+
+func (h *Handle) Status() Status {
+	g := h.state.gate
+	g.mu.Lock()
+	s := Status{State: Running, Emitted: g.emitted}
+	switch {
+	case g.draining:
+		s.State = Draining
+	case g.paused:
+		s.State = Paused
+	}
+	g.mu.Unlock()
+
+	s.Goroutines = h.state.live.Load()
+	if s.Goroutines == 0 {
+		s.State = Finished
+	}
+	s.Err = h.Err()
+	return s
+}
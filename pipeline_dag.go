@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+//非线性的 Pipeline
+//pipeline 只能把 stage 连成一条直线，Tee 把一个数据流复制为多个分支，Merge 把多个分支合并为一个，
+//组合起来就可以构建任意的有向无环图
+//Tee 的每个分支都必须被读取，否则其他分支也会阻塞
+
+//把多个 channel 合并为一个，所有输入都关闭后关闭输出
+func Merge[T any](ctx context.Context, chans ...<-chan T) <-chan T {
+	out := make(chan T)
+	var wg sync.WaitGroup
+	wg.Add(len(chans))
+	for _, ch := range chans {
+		goStage(ctx, func() {
+			defer wg.Done()
+			for v := range ch {
+				if !send(ctx, out, v) {
+					return
+				}
+			}
+		})
+	}
+	goStage(ctx, func() {
+		wg.Wait()
+		close(out)
+	})
+	return out
+}
+
+//把 in 中的每个元素都发送给 n 个输出，in 关闭后关闭所有的输出
+func Tee[T any](ctx context.Context, in <-chan T, n int) []<-chan T {
+	outs := make([]chan T, n)
+	res := make([]<-chan T, n)
+	for i := range outs {
+		outs[i] = make(chan T)
+		res[i] = outs[i]
+	}
+
+	goStage(ctx, func() {
+		defer func() {
+			for _, out := range outs {
+				close(out)
+			}
+		}()
+		for v := range in {
+			for _, out := range outs {
+				if !send(ctx, out, v) {
+					return
+				}
+			}
+		}
+	})
+	return res
+}
+
+type builtNode struct {
+	once sync.Once
+	v    any
+}
+
+//在一次运行中，同一个 key 只调用一次 build，之后返回第一次的结果
+func buildOnce(ctx context.Context, key any, build func() any) any {
+	rs := getRunState(ctx)
+	if rs == nil {
+		return build()
+	}
+
+	rs.mu.Lock()
+	if rs.built == nil {
+		rs.built = make(map[any]*builtNode)
+	}
+	node, ok := rs.built[key]
+	if !ok {
+		node = &builtNode{}
+		rs.built[key] = node
+	}
+	rs.mu.Unlock()
+
+	//build 中可能还会构建其他的节点，所以不能持有锁
+	node.once.Do(func() {
+		node.v = build()
+	})
+	return node.v
+}
+
+type teeNode[T any] struct {
+	src *Flow[T]
+	n   int
+}
+
+//把 f 复制为 n 个分支，所有分支共享同一个上游
+//	branches := Broadcast(From(FromSlice(nums)), 2)
+//	merged := MergeFlows(branches[0].Pipe(ctxSquare), branches[1].Pipe(ctxOdd))
+func Broadcast[T any](f *Flow[T], n int) []*Flow[T] {
+	node := &teeNode[T]{src: f, n: n}
+	flows := make([]*Flow[T], n)
+	for i := range flows {
+		flows[i] = &Flow[T]{build: func(ctx context.Context) <-chan T {
+			outs := buildOnce(ctx, node, func() any {
+				in := node.src.build(ctx)
+				ctx, rec, id := beginNode(ctx, "broadcast", "broadcast", in)
+				annotateFanOut(ctx, node.n)
+				outs := Tee(ctx, in, node.n)
+				for _, out := range outs {
+					rec.output(id, out, cap(out))
+				}
+				return outs
+			}).([]<-chan T)
+			return outs[i]
+		}}
+	}
+	return flows
+}
+
+//把多个 Flow 的输出合并为一个
+func MergeFlows[T any](flows ...*Flow[T]) *Flow[T] {
+	return &Flow[T]{build: func(ctx context.Context) <-chan T {
+		chans := make([]<-chan T, len(flows))
+		ins := make([]any, len(flows))
+		for i, f := range flows {
+			chans[i] = f.build(ctx)
+			ins[i] = chans[i]
+		}
+		return traceNode(ctx, "merge", "merge", ins, func(ctx context.Context) <-chan T {
+			return Merge(ctx, chans...)
+		})
+	}}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"hash/maphash"
+	"math"
+)
+
+//去重
+//用一个 map 记录所有见过的元素，数据流很大时内存会无限增长，Distinct 提供两种有界的方式：
+//	精确模式：只记住最近见过的 n 个元素，更早的元素再次出现时会被当作新元素输出
+//	概率模式：使用 Bloom filter，内存固定，不会漏掉重复的元素，但会有一定的比例把新元素误判为重复而丢弃
+
+type dedupConfig struct {
+	capacity int
+	expected int
+	fpRate   float64
+}
+
+type DedupOption func(*dedupConfig)
+
+//精确模式，最多记住最近见过的 n 个元素，n <= 0 时不限制
+func RememberLast(n int) DedupOption {
+	return func(c *dedupConfig) {
+		c.capacity = n
+		c.expected = 0
+	}
+}
+
+//概率模式，Bloom filter 按照 expected 个不同的元素和 fpRate 的误判率分配内存
+//实际的元素超过 expected 时，误判率会逐渐升高
+func Bloom(expected int, fpRate float64) DedupOption {
+	return func(c *dedupConfig) {
+		c.expected = max(expected, 1)
+		c.fpRate = fpRate
+		if fpRate <= 0 || fpRate >= 1 {
+			c.fpRate = 0.01
+		}
+	}
+}
+
+//丢弃重复的元素，只输出每个元素第一次出现的位置，不设置选项时和使用 map 一样不限制内存
+func Distinct[T comparable](opts ...DedupOption) Stage[T, T] {
+	var cfg dedupConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	return func(ctx context.Context, in <-chan T) <-chan T {
+		//每次运行使用新的状态
+		var seen func(T) bool
+		if cfg.expected > 0 {
+			seen = newBloomFilter[T](cfg.expected, cfg.fpRate).testAndAdd
+		} else {
+			seen = newLRUSet[T](cfg.capacity).testAndAdd
+		}
+		return FilterStage(func(v T) bool {
+			return !seen(v)
+		})(ctx, in)
+	}
+}
+
+//	pipeline(nums, echo, DistinctPipe(Bloom(1000000, 0.001)), sum)
+func DistinctPipe(opts ...DedupOption) PipeFunc {
+	return asPipeFunc(Distinct[int](opts...))
+}
+
+//最多保留 capacity 个元素的集合，满了之后淘汰最久没有见过的元素
+type lruSet[T comparable] struct {
+	capacity int
+	items    map[T]*list.Element
+	order    *list.List
+}
+
+func newLRUSet[T comparable](capacity int) *lruSet[T] {
+	return &lruSet[T]{capacity: capacity, items: make(map[T]*list.Element), order: list.New()}
+}
+
+//返回 v 是否已经在集合中，并把 v 记为最近见过的元素
+func (s *lruSet[T]) testAndAdd(v T) bool {
+	if e, ok := s.items[v]; ok {
+		s.order.MoveToBack(e)
+		return true
+	}
+	if s.capacity > 0 && s.order.Len() >= s.capacity {
+		oldest := s.order.Remove(s.order.Front()).(T)
+		delete(s.items, oldest)
+	}
+	s.items[v] = s.order.PushBack(v)
+	return false
+}
+
+type bloomFilter[T comparable] struct {
+	bits  []uint64
+	m     uint64
+	k     int
+	seed1 maphash.Seed
+	seed2 maphash.Seed
+}
+
+//按照 n 个元素、误判率 p 计算位数 m = -n·ln(p)/(ln2)² 和哈希函数的个数 k = m/n·ln2
+func newBloomFilter[T comparable](n int, p float64) *bloomFilter[T] {
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	m = max(m, 64)
+	k := max(int(math.Round(float64(m)/float64(n)*math.Ln2)), 1)
+	return &bloomFilter[T]{
+		bits:  make([]uint64, (m+63)/64),
+		m:     m,
+		k:     k,
+		seed1: maphash.MakeSeed(),
+		seed2: maphash.MakeSeed(),
+	}
+}
+
+//返回 v 是否可能已经在集合中，并把 v 加入集合
+//k 个哈希值由两个哈希值组合得到：h1 + i·h2
+func (b *bloomFilter[T]) testAndAdd(v T) bool {
+	h1 := maphash.Comparable(b.seed1, v)
+	h2 := maphash.Comparable(b.seed2, v) | 1
+	present := true
+	for i := 0; i < b.k; i++ {
+		bit := (h1 + uint64(i)*h2) % b.m
+		word, mask := bit/64, uint64(1)<<(bit%64)
+		if b.bits[word]&mask == 0 {
+			present = false
+			b.bits[word] |= mask
+		}
+	}
+	return present
+}
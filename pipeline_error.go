@@ -0,0 +1,101 @@
+package main
+
+import "context"
+
+//Pipeline 中的错误处理
+//stage 通过 ReportError 报告错误，和 errgroup 一样，第一个错误会取消整个 pipeline，
+//调用方在读完输出之后通过 Handle.Wait 拿到错误
+
+//带有 stage 名字的错误
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return e.Stage + ": " + e.Err.Error()
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+type stageNameKey struct{}
+
+//为 stage 命名，stage 报告的错误会带上这个名字
+func Named[A, B any](name string, stage Stage[A, B]) Stage[A, B] {
+	return func(ctx context.Context, in <-chan A) <-chan B {
+		annotateName(ctx, name)
+		return stage(context.WithValue(ctx, stageNameKey{}, name), in)
+	}
+}
+
+//为数据源命名
+func NamedSource[T any](name string, src Source[T]) Source[T] {
+	return func(ctx context.Context) <-chan T {
+		annotateName(ctx, name)
+		return src(context.WithValue(ctx, stageNameKey{}, name))
+	}
+}
+
+func stageName(ctx context.Context) string {
+	name, _ := ctx.Value(stageNameKey{}).(string)
+	return name
+}
+
+//报告一个错误并取消当前的 pipeline
+func ReportError(ctx context.Context, err error) {
+	rs := getRunState(ctx)
+	if rs == nil || err == nil {
+		return
+	}
+	if name := stageName(ctx); name != "" {
+		err = &StageError{name, err}
+	}
+	rs.recordError(err)
+}
+
+func (rs *runState) recordError(err error) {
+	rs.mu.Lock()
+	rs.errs = append(rs.errs, err)
+	rs.mu.Unlock()
+	rs.cancel()
+}
+
+//返回第一个错误
+func (h *Handle) Err() error {
+	h.state.mu.Lock()
+	defer h.state.mu.Unlock()
+	if len(h.state.errs) == 0 {
+		return nil
+	}
+	return h.state.errs[0]
+}
+
+//返回所有的错误，pipeline 取消之前其他 stage 可能也已经失败了
+func (h *Handle) Errors() []error {
+	h.state.mu.Lock()
+	defer h.state.mu.Unlock()
+	return append([]error(nil), h.state.errs...)
+}
+
+//可能失败的 MapStage，fn 返回错误时报告错误并结束
+func TryMap[A, B any](fn func(A) (B, error)) Stage[A, B] {
+	return func(ctx context.Context, in <-chan A) <-chan B {
+		out := make(chan B)
+		goStage(ctx, func() {
+			defer close(out)
+			for v := range in {
+				res, err := fn(v)
+				if err != nil {
+					ReportError(ctx, err)
+					return
+				}
+				if !send(ctx, out, res) {
+					return
+				}
+			}
+		})
+		return out
+	}
+}
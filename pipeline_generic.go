@@ -0,0 +1,132 @@
+package main
+
+import "context"
+
+//泛型 Pipeline
+//EchoFunc 和 PipeFunc 只能处理 int，使用泛型之后 stage 可以把 <-chan A 转换为 <-chan B
+
+type Source[T any] func(ctx context.Context) <-chan T
+type Stage[A, B any] func(ctx context.Context, in <-chan A) <-chan B
+
+//把切片作为数据源，相当于泛型版本的 echo
+func FromSlice[T any](items []T) Source[T] {
+	return func(ctx context.Context) <-chan T {
+		out := make(chan T)
+		goStage(ctx, func() {
+			defer close(out)
+			for _, v := range items {
+				if !send(ctx, out, v) {
+					return
+				}
+			}
+		})
+		return out
+	}
+}
+
+//把 CtxEchoFunc 适配为 Source
+func FromEcho(echoFunc CtxEchoFunc, nums []int) Source[int] {
+	return func(ctx context.Context) <-chan int {
+		return echoFunc(ctx, nums)
+	}
+}
+
+//对每个元素执行 fn，可以改变元素类型
+func MapStage[A, B any](fn func(A) B) Stage[A, B] {
+	return func(ctx context.Context, in <-chan A) <-chan B {
+		out := make(chan B)
+		goStage(ctx, func() {
+			defer close(out)
+			for v := range in {
+				res := fn(v)
+				if !send(ctx, out, res) {
+					return
+				}
+			}
+		})
+		return out
+	}
+}
+
+//只保留 fn 返回 true 的元素
+func FilterStage[T any](fn func(T) bool) Stage[T, T] {
+	return func(ctx context.Context, in <-chan T) <-chan T {
+		out := make(chan T)
+		goStage(ctx, func() {
+			defer close(out)
+			for v := range in {
+				keep := fn(v)
+				if keep && !send(ctx, out, v) {
+					return
+				}
+			}
+		})
+		return out
+	}
+}
+
+//把所有元素聚合为一个结果，在输入结束后输出，相当于泛型版本的 sum
+func ReduceStage[T, R any](zero R, fn func(R, T) R) Stage[T, R] {
+	return func(ctx context.Context, in <-chan T) <-chan R {
+		out := make(chan R)
+		goStage(ctx, func() {
+			defer close(out)
+			acc := zero
+			for v := range in {
+				acc = fn(acc, v)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			send(ctx, out, acc)
+		})
+		return out
+	}
+}
+
+//Flow 以链式调用的方式构建 pipeline，整条链路的类型在编译期检查
+//Go 的方法不能有类型参数，所以改变元素类型的 stage 需要使用函数 Then 连接
+//	parsed := Then(From(FromSlice(lines)), MapStage(parse))
+//	out, h := Then(parsed.Pipe(valid), ReduceStage(0, add)).Run(ctx)
+type Flow[T any] struct {
+	build func(ctx context.Context) <-chan T
+}
+
+func From[T any](src Source[T]) *Flow[T] {
+	return &Flow[T]{build: func(ctx context.Context) <-chan T {
+		return traceNode(ctx, "source", funcName(src), nil, func(ctx context.Context) <-chan T {
+			return gateSource(ctx, src)
+		})
+	}}
+}
+
+//追加若干个不改变元素类型的 stage
+func (f *Flow[T]) Pipe(stages ...Stage[T, T]) *Flow[T] {
+	return &Flow[T]{build: func(ctx context.Context) <-chan T {
+		ch := f.build(ctx)
+		for _, stage := range stages {
+			ch = traceStage(ctx, stage, ch)
+		}
+		return ch
+	}}
+}
+
+//追加一个把 A 转换为 B 的 stage
+func Then[A, B any](f *Flow[A], stage Stage[A, B]) *Flow[B] {
+	return &Flow[B]{build: func(ctx context.Context) <-chan B {
+		return traceStage(ctx, stage, f.build(ctx))
+	}}
+}
+
+//构建 stage，并把它记录为拓扑结构中的一个节点
+func traceStage[A, B any](ctx context.Context, stage Stage[A, B], in <-chan A) <-chan B {
+	return traceNode(ctx, "stage", funcName(stage), []any{in}, func(ctx context.Context) <-chan B {
+		return stage(ctx, in)
+	})
+}
+
+//启动 pipeline，返回最终的输出和用于控制的 Handle
+func (f *Flow[T]) Run(ctx context.Context) (<-chan T, *Handle) {
+	ctx, rs := withRunState(ctx)
+	return f.build(ctx), &Handle{state: rs}
+}
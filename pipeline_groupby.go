@@ -0,0 +1,118 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"time"
+)
+
+//按 key 分组聚合
+//sum 把整个数据流聚合为一个数，GroupBy 按照 key 把数据流分组，每个 key 单独维护聚合的状态，
+//在输入结束时或者每个窗口结束时输出每个 key 的结果
+
+type Keyed[K comparable, R any] struct {
+	Key   K
+	Value R
+}
+
+type groupConfig struct {
+	window  time.Duration
+	maxKeys int
+}
+
+type GroupOption func(*groupConfig)
+
+//每隔 d 输出一次所有 key 的结果并清空状态，不设置时只在输入结束时输出
+func FlushEvery(d time.Duration) GroupOption {
+	return func(c *groupConfig) {
+		c.window = d
+	}
+}
+
+//最多同时保留 n 个 key 的状态，超过时提前输出最久没有更新的 key 并丢弃它的状态，
+//这个 key 之后的元素会重新开始聚合，所以同一个 key 可能会输出多次
+func MaxKeys(n int) GroupOption {
+	return func(c *groupConfig) {
+		c.maxKeys = n
+	}
+}
+
+//按照 key 函数分组，每组从 zero 开始用 fn 聚合
+func GroupBy[T any, K comparable, R any](key func(T) K, zero R, fn func(R, T) R, opts ...GroupOption) Stage[T, Keyed[K, R]] {
+	var cfg groupConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	return func(ctx context.Context, in <-chan T) <-chan Keyed[K, R] {
+		out := make(chan Keyed[K, R])
+		goStage(ctx, func() {
+			defer close(out)
+
+			//lru 中的元素按照最后更新的时间排列，最前面的是最久没有更新的
+			lru := list.New()
+			groups := make(map[K]*list.Element)
+
+			flush := func() bool {
+				for e := lru.Front(); e != nil; e = e.Next() {
+					if !send(ctx, out, e.Value.(Keyed[K, R])) {
+						return false
+					}
+				}
+				lru.Init()
+				clear(groups)
+				return true
+			}
+
+			add := func(v T) bool {
+				k := key(v)
+				if e, ok := groups[k]; ok {
+					g := e.Value.(Keyed[K, R])
+					g.Value = fn(g.Value, v)
+					e.Value = g
+					lru.MoveToBack(e)
+					return true
+				}
+
+				if cfg.maxKeys > 0 && lru.Len() >= cfg.maxKeys {
+					oldest := lru.Remove(lru.Front()).(Keyed[K, R])
+					delete(groups, oldest.Key)
+					if !send(ctx, out, oldest) {
+						return false
+					}
+				}
+				groups[k] = lru.PushBack(Keyed[K, R]{k, fn(zero, v)})
+				return true
+			}
+
+			var tick <-chan time.Time
+			if cfg.window > 0 {
+				ticker := clockFrom(ctx).NewTicker(cfg.window)
+				defer ticker.Stop()
+				tick = ticker.C()
+			}
+
+			for {
+				select {
+				case v, ok := <-in:
+					if !ok {
+						if ctx.Err() == nil {
+							flush()
+						}
+						return
+					}
+					if !add(v) {
+						return
+					}
+				case <-tick:
+					if !flush() {
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+		return out
+	}
+}
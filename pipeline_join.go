@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+//按 key 连接两个数据流
+//例如订单和支付记录：两边的元素各自缓存在窗口中，一边来了新元素，就和另一边窗口中 key 相同的元素配对输出
+//窗口可以按时间划分（JoinWithin），也可以按元素个数划分（JoinLast），
+//元素滑出窗口时如果一次都没有配对成功，可以作为 outer 的结果单独输出（LeftOuter、RightOuter）
+
+type JoinSide int
+
+const (
+	//左右两边配对成功
+	Matched JoinSide = iota
+	//只有 Left 有效，右边在窗口内没有 key 相同的元素
+	LeftOnly
+	//只有 Right 有效
+	RightOnly
+)
+
+type Joined[K comparable, L, R any] struct {
+	Key   K
+	Left  L
+	Right R
+	Side  JoinSide
+}
+
+type joinConfig struct {
+	within     time.Duration
+	last       int
+	leftOuter  bool
+	rightOuter bool
+}
+
+type JoinOption func(*joinConfig)
+
+//元素在到达之后的 d 时间内可以被配对，使用 ctx 中的时钟，见 pipeline_clock.go
+//滑出窗口的元素最多延迟 d 才作为 outer 的结果输出
+func JoinWithin(d time.Duration) JoinOption {
+	return func(c *joinConfig) {
+		c.within = d
+	}
+}
+
+//每一边最多缓存最近的 n 个元素
+func JoinLast(n int) JoinOption {
+	return func(c *joinConfig) {
+		c.last = n
+	}
+}
+
+//输出左边没有配对成功的元素
+func LeftOuter() JoinOption {
+	return func(c *joinConfig) {
+		c.leftOuter = true
+	}
+}
+
+//输出右边没有配对成功的元素
+func RightOuter() JoinOption {
+	return func(c *joinConfig) {
+		c.rightOuter = true
+	}
+}
+
+type joinEntry[K comparable, T any] struct {
+	key     K
+	value   T
+	at      time.Time
+	matched bool
+}
+
+//一边的窗口，queue 按照到达的顺序排列，index 按 key 索引
+type joinBuffer[K comparable, T any] struct {
+	queue []*joinEntry[K, T]
+	index map[K][]*joinEntry[K, T]
+}
+
+func newJoinBuffer[K comparable, T any]() *joinBuffer[K, T] {
+	return &joinBuffer[K, T]{index: make(map[K][]*joinEntry[K, T])}
+}
+
+func (b *joinBuffer[K, T]) add(e *joinEntry[K, T]) {
+	b.queue = append(b.queue, e)
+	b.index[e.key] = append(b.index[e.key], e)
+}
+
+//淘汰滑出窗口的元素，drain 为 true 时淘汰所有元素
+//没有配对过的元素交给 emit，emit 为 nil 时直接丢弃，emit 返回 false 时停止
+func (b *joinBuffer[K, T]) expire(cfg *joinConfig, now time.Time, drain bool, emit func(*joinEntry[K, T]) bool) bool {
+	for len(b.queue) > 0 {
+		e := b.queue[0]
+		expired := drain ||
+			(cfg.within > 0 && !e.at.After(now.Add(-cfg.within))) ||
+			(cfg.last > 0 && len(b.queue) > cfg.last)
+		if !expired {
+			break
+		}
+
+		b.queue[0] = nil
+		b.queue = b.queue[1:]
+		//同一个 key 的元素也是按照到达的顺序排列的，最早的一定是 e
+		if same := b.index[e.key]; len(same) == 1 {
+			delete(b.index, e.key)
+		} else {
+			b.index[e.key] = same[1:]
+		}
+		if !e.matched && emit != nil && !emit(e) {
+			return false
+		}
+	}
+	return true
+}
+
+//连接 left 和 right 中 key 相同的元素，一个元素可以和窗口内的多个元素配对
+//不设置窗口时，元素会一直缓存到两边的输入都结束
+func Join[K comparable, L, R any](left *Flow[L], right *Flow[R], leftKey func(L) K, rightKey func(R) K, opts ...JoinOption) *Flow[Joined[K, L, R]] {
+	var cfg joinConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	return &Flow[Joined[K, L, R]]{build: func(ctx context.Context) <-chan Joined[K, L, R] {
+		lc, rc := left.build(ctx), right.build(ctx)
+		return traceNode(ctx, "join", "join", []any{lc, rc}, func(ctx context.Context) <-chan Joined[K, L, R] {
+			return joinChans(ctx, lc, rc, leftKey, rightKey, &cfg)
+		})
+	}}
+}
+
+func joinChans[K comparable, L, R any](ctx context.Context, lc <-chan L, rc <-chan R, leftKey func(L) K, rightKey func(R) K, cfg *joinConfig) <-chan Joined[K, L, R] {
+	out := make(chan Joined[K, L, R])
+	goStage(ctx, func() {
+		defer close(out)
+		clock := clockFrom(ctx)
+		lbuf, rbuf := newJoinBuffer[K, L](), newJoinBuffer[K, R]()
+
+		var emitLeft func(*joinEntry[K, L]) bool
+		if cfg.leftOuter {
+			emitLeft = func(e *joinEntry[K, L]) bool {
+				return send(ctx, out, Joined[K, L, R]{Key: e.key, Left: e.value, Side: LeftOnly})
+			}
+		}
+		var emitRight func(*joinEntry[K, R]) bool
+		if cfg.rightOuter {
+			emitRight = func(e *joinEntry[K, R]) bool {
+				return send(ctx, out, Joined[K, L, R]{Key: e.key, Right: e.value, Side: RightOnly})
+			}
+		}
+		expire := func(now time.Time, drain bool) bool {
+			return lbuf.expire(cfg, now, drain, emitLeft) && rbuf.expire(cfg, now, drain, emitRight)
+		}
+
+		//按时间划分窗口时，即使没有新的元素，也要定期淘汰过期的元素
+		var tick <-chan time.Time
+		if cfg.within > 0 {
+			ticker := clock.NewTicker(cfg.within)
+			defer ticker.Stop()
+			tick = ticker.C()
+		}
+
+		for lc != nil || rc != nil {
+			select {
+			case l, ok := <-lc:
+				if !ok {
+					lc = nil
+					continue
+				}
+				now := clock.Now()
+				if !expire(now, false) {
+					return
+				}
+				e := &joinEntry[K, L]{key: leftKey(l), value: l, at: now}
+				for _, r := range rbuf.index[e.key] {
+					e.matched, r.matched = true, true
+					if !send(ctx, out, Joined[K, L, R]{e.key, l, r.value, Matched}) {
+						return
+					}
+				}
+				lbuf.add(e)
+				if !expire(now, false) {
+					return
+				}
+			case r, ok := <-rc:
+				if !ok {
+					rc = nil
+					continue
+				}
+				now := clock.Now()
+				if !expire(now, false) {
+					return
+				}
+				e := &joinEntry[K, R]{key: rightKey(r), value: r, at: now}
+				for _, l := range lbuf.index[e.key] {
+					e.matched, l.matched = true, true
+					if !send(ctx, out, Joined[K, L, R]{e.key, l.value, r, Matched}) {
+						return
+					}
+				}
+				rbuf.add(e)
+				if !expire(now, false) {
+					return
+				}
+			case now := <-tick:
+				if !expire(now, false) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if ctx.Err() == nil {
+			expire(clock.Now(), true)
+		}
+	})
+	return out
+}
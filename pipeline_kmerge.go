@@ -0,0 +1,109 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+)
+
+//多路归并
+//Merge 按照到达的先后顺序合并多个 channel，MergeSorted 则假设每个输入都已经有序，
+//用一个小顶堆合并为一个整体有序的输出，例如按时间戳合并多个日志文件
+//每个输入都要先产生一个元素，或者关闭，才能确定下一个输出，所以一个很慢的输入会拖慢整个输出
+
+type mergeItem[T any] struct {
+	value T
+	from  int
+}
+
+//container/heap 需要的接口，cmp 和 slices.SortFunc 的参数相同
+type mergeHeap[T any] struct {
+	items []mergeItem[T]
+	cmp   func(a, b T) int
+}
+
+func (h *mergeHeap[T]) Len() int {
+	return len(h.items)
+}
+
+//值相同的元素按照输入的顺序输出，结果是确定的
+func (h *mergeHeap[T]) Less(i, j int) bool {
+	if c := h.cmp(h.items[i].value, h.items[j].value); c != 0 {
+		return c < 0
+	}
+	return h.items[i].from < h.items[j].from
+}
+
+func (h *mergeHeap[T]) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+}
+
+func (h *mergeHeap[T]) Push(x any) {
+	h.items = append(h.items, x.(mergeItem[T]))
+}
+
+func (h *mergeHeap[T]) Pop() any {
+	n := len(h.items)
+	item := h.items[n-1]
+	h.items = h.items[:n-1]
+	return item
+}
+
+//把多个有序的 channel 合并为一个有序的 channel，所有输入都关闭后关闭输出
+func MergeSorted[T any](ctx context.Context, cmp func(a, b T) int, chans ...<-chan T) <-chan T {
+	out := make(chan T)
+	goStage(ctx, func() {
+		defer close(out)
+
+		//从第 i 个输入读取下一个元素放入堆中，输入关闭时什么也不做
+		h := &mergeHeap[T]{cmp: cmp}
+		next := func(i int) bool {
+			select {
+			case v, ok := <-chans[i]:
+				if ok {
+					heap.Push(h, mergeItem[T]{v, i})
+				}
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for i := range chans {
+			if !next(i) {
+				return
+			}
+		}
+		for h.Len() > 0 {
+			item := heap.Pop(h).(mergeItem[T])
+			if !send(ctx, out, item.value) || !next(item.from) {
+				return
+			}
+		}
+	})
+	return out
+}
+
+//把多个有序的 Flow 归并为一个
+func MergeSortedFlows[T any](cmp func(a, b T) int, flows ...*Flow[T]) *Flow[T] {
+	return &Flow[T]{build: func(ctx context.Context) <-chan T {
+		chans := make([]<-chan T, len(flows))
+		ins := make([]any, len(flows))
+		for i, f := range flows {
+			chans[i] = f.build(ctx)
+			ins[i] = chans[i]
+		}
+		return traceNode(ctx, "merge", "merge sorted", ins, func(ctx context.Context) <-chan T {
+			return MergeSorted(ctx, cmp, chans...)
+		})
+	}}
+}
+
+//把多个有序的数据源归并为一个数据源
+//	From(MergeSortedSources(strings.Compare, ReaderLines(a), ReaderLines(b))).Pipe(...)
+func MergeSortedSources[T any](cmp func(a, b T) int, srcs ...Source[T]) Source[T] {
+	flows := make([]*Flow[T], len(srcs))
+	for i, src := range srcs {
+		flows[i] = From(src)
+	}
+	return MergeSortedFlows(cmp, flows...).Source()
+}
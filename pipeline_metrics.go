@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Pipeline 的监控指标
+//使用 Instrument 包装一个 stage 之后，可以统计它的输入输出个数、处理耗时分布和输入队列的占用情况，
+//通过 Snapshot 读取，或者通过 Handler 以 Prometheus 文本格式导出
+//stage 之间的 channel 没有缓冲，Instrument 在 stage 前面加一个有界的队列，队列的长度反映了 stage 跟不上上游的程度
+//处理耗时由 Instrument 统计：从 stage 接收一个元素开始，到 stage 下一次输出为止，任何 stage 都不需要自己上报
+
+//耗时分布的桶，单位是秒
+var latencyBuckets = []float64{0.00001, 0.0001, 0.001, 0.01, 0.1, 1, 10}
+
+type stageMetrics struct {
+	name string
+	in   atomic.Int64
+	out  atomic.Int64
+
+	//latencyCounts[i] 是耗时落在 (latencyBuckets[i-1], latencyBuckets[i]] 中的次数，最后一个是超出所有桶的次数
+	latencyCounts []atomic.Int64
+	latencySum    atomic.Int64 //纳秒
+
+	queueLen atomic.Int64
+	queueCap atomic.Int64
+}
+
+//记录从 start 开始处理一个元素的耗时
+func (sm *stageMetrics) observe(start time.Time) {
+	d := time.Since(start)
+	i := 0
+	for i < len(latencyBuckets) && d.Seconds() > latencyBuckets[i] {
+		i++
+	}
+	sm.latencyCounts[i].Add(1)
+	sm.latencySum.Add(int64(d))
+}
+
+//一组 stage 的监控指标
+type Metrics struct {
+	mu     sync.Mutex
+	stages []*stageMetrics
+	byName map[string]*stageMetrics
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{byName: make(map[string]*stageMetrics)}
+}
+
+func (m *Metrics) stage(name string) *stageMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if sm, ok := m.byName[name]; ok {
+		return sm
+	}
+	sm := &stageMetrics{name: name, latencyCounts: make([]atomic.Int64, len(latencyBuckets)+1)}
+	m.stages = append(m.stages, sm)
+	m.byName[name] = sm
+	return sm
+}
+
+type instrumentConfig struct {
+	queue int
+}
+
+type InstrumentOption func(*instrumentConfig)
+
+//stage 前面的队列最多存放 n 个元素，默认 16，0 表示不缓冲，这时队列的长度总是 0
+func QueueSize(n int) InstrumentOption {
+	return func(c *instrumentConfig) {
+		c.queue = max(n, 0)
+	}
+}
+
+//包装一个 stage，统计的结果记录在 m 中名为 name 的条目下
+func Instrument[A, B any](m *Metrics, name string, stage Stage[A, B], opts ...InstrumentOption) Stage[A, B] {
+	cfg := instrumentConfig{queue: 16}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	sm := m.stage(name)
+	return func(ctx context.Context, in <-chan A) <-chan B {
+		annotateName(ctx, name)
+		annotateNode(ctx, func(n *TopoNode, _ *bool) {
+			if n.Metrics == "" {
+				n.Metrics = name
+			}
+		})
+		sm.queueCap.Store(int64(cfg.queue))
+
+		//同一个 goroutine 把队列中的元素交给 stage、读取 stage 的输出，
+		//交出元素就是 stage 接收的时间，两件事的先后顺序是确定的
+		feed := make(chan A)
+		res := stage(ctx, feed)
+		out := make(chan B)
+		goStage(ctx, func() {
+			defer close(out)
+			var queue []A
+			defer func() {
+				if feed != nil {
+					close(feed)
+				}
+				sm.queueLen.Add(-int64(len(queue)))
+			}()
+			//上一次输出之后 stage 接收第一个元素的时间
+			var since time.Time
+			var result B
+			hasResult := false
+
+			for res != nil || hasResult {
+				if in == nil && len(queue) == 0 && feed != nil {
+					close(feed)
+					feed = nil
+				}
+				recv := in
+				if len(queue) >= max(cfg.queue, 1) {
+					recv = nil
+				}
+				var handoff chan<- A
+				var next A
+				if len(queue) > 0 {
+					handoff, next = feed, queue[0]
+				}
+				results, emit := res, chan<- B(nil)
+				if hasResult {
+					results, emit = nil, out
+				}
+
+				select {
+				case v, ok := <-recv:
+					if !ok {
+						in = nil
+						continue
+					}
+					sm.in.Add(1)
+					queue = append(queue, v)
+					if cfg.queue > 0 {
+						sm.queueLen.Add(1)
+					}
+				case handoff <- next:
+					var zero A
+					queue[0] = zero
+					queue = queue[1:]
+					if cfg.queue > 0 {
+						sm.queueLen.Add(-1)
+					}
+					if since.IsZero() {
+						since = time.Now()
+					}
+				case v, ok := <-results:
+					if !ok {
+						res = nil
+						continue
+					}
+					sm.out.Add(1)
+					if !since.IsZero() {
+						sm.observe(since)
+						since = time.Time{}
+					}
+					result, hasResult = v, true
+				case emit <- result:
+					var zero B
+					result, hasResult = zero, false
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+		return out
+	}
+}
+
+//	pipeline(nums, echo, InstrumentPipe(m, "square", square), sum)
+func InstrumentPipe(m *Metrics, name string, fn PipeFunc, opts ...InstrumentOption) PipeFunc {
+	return asPipeFunc(Instrument(m, name, pipeStage(fn), opts...))
+}
+
+type LatencySnapshot struct {
+	Buckets []float64 //桶的上界，单位是秒
+	Counts  []int64   //累计的次数，Counts[i] 是耗时不超过 Buckets[i] 的次数
+	Count   int64
+	Sum     time.Duration
+}
+
+type StageSnapshot struct {
+	Name     string
+	In       int64
+	Out      int64
+	QueueLen int //输入队列中排队的元素个数
+	QueueCap int //输入队列的容量，见 QueueSize
+	Latency  LatencySnapshot
+}
+
+//读取所有 stage 当前的指标，按 Instrument 的顺序排列
+func (m *Metrics) Snapshot() []StageSnapshot {
+	m.mu.Lock()
+	stages := append([]*stageMetrics(nil), m.stages...)
+	m.mu.Unlock()
+
+	res := make([]StageSnapshot, 0, len(stages))
+	for _, sm := range stages {
+		snap := StageSnapshot{
+			Name:     sm.name,
+			In:       sm.in.Load(),
+			Out:      sm.out.Load(),
+			QueueLen: int(sm.queueLen.Load()),
+			QueueCap: int(sm.queueCap.Load()),
+		}
+
+		snap.Latency.Buckets = latencyBuckets
+		snap.Latency.Counts = make([]int64, len(latencyBuckets))
+		var total int64
+		for i := range sm.latencyCounts {
+			total += sm.latencyCounts[i].Load()
+			if i < len(latencyBuckets) {
+				snap.Latency.Counts[i] = total
+			}
+		}
+		snap.Latency.Count = total
+		snap.Latency.Sum = time.Duration(sm.latencySum.Load())
+		res = append(res, snap)
+	}
+	return res
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+//以 Prometheus 文本格式输出所有指标
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	snaps := m.Snapshot()
+	var b strings.Builder
+	metric := func(name, typ, help string, value func(s StageSnapshot) float64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, s := range snaps {
+			fmt.Fprintf(&b, "%s{stage=\"%s\"} %v\n", name, labelEscaper.Replace(s.Name), value(s))
+		}
+	}
+	metric("pipeline_stage_items_in_total", "counter", "Items received by the stage.",
+		func(s StageSnapshot) float64 { return float64(s.In) })
+	metric("pipeline_stage_items_out_total", "counter", "Items emitted by the stage.",
+		func(s StageSnapshot) float64 { return float64(s.Out) })
+	metric("pipeline_stage_queue_length", "gauge", "Items waiting in the input queue of the stage.",
+		func(s StageSnapshot) float64 { return float64(s.QueueLen) })
+	metric("pipeline_stage_queue_capacity", "gauge", "Capacity of the input queue of the stage.",
+		func(s StageSnapshot) float64 { return float64(s.QueueCap) })
+
+	name := "pipeline_stage_latency_seconds"
+	fmt.Fprintf(&b, "# HELP %s Time from the stage receiving an item to its next output.\n# TYPE %s histogram\n", name, name)
+	for _, s := range snaps {
+		stage := labelEscaper.Replace(s.Name)
+		for i, le := range s.Latency.Buckets {
+			fmt.Fprintf(&b, "%s_bucket{stage=\"%s\",le=\"%v\"} %d\n", name, stage, le, s.Latency.Counts[i])
+		}
+		fmt.Fprintf(&b, "%s_bucket{stage=\"%s\",le=\"+Inf\"} %d\n", name, stage, s.Latency.Count)
+		fmt.Fprintf(&b, "%s_sum{stage=\"%s\"} %v\n", name, stage, s.Latency.Sum.Seconds())
+		fmt.Fprintf(&b, "%s_count{stage=\"%s\"} %d\n", name, stage, s.Latency.Count)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+//以 Prometheus 文本格式导出指标的 http handler
+//	http.Handle("/metrics", m.Handler())
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.WritePrometheus(w)
+	})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+//隔离 stage 中的 panic
+//一个 goroutine 中的 panic 会让整个程序崩溃，所有通过 goStage 启动的 goroutine 都会 recover，
+//把 panic 转换为带有 stage 名字和调用栈的 PanicError，然后像普通的错误一样取消整个 pipeline
+//pipeline.go 中最初的 echo、square 等函数以及各个 *Pipe 适配器没有 ctx 参数，它们通过输入的 channel 找到所在的 pipeline：
+//	每次调用 pipeline 都有自己的运行状态，一个 pipeline 出错不会影响同时运行的其他 pipeline
+//	pipelineWithHandle 返回这次调用的 Handle，通过它等待结束并读取错误
+//	不通过 pipeline 直接嵌套调用时，例如 sum(square(echo(nums)))，从数据源开始的一条链共享一个运行状态
+
+type PanicError struct {
+	Stage string
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%s: panic: %v", e.Stage, e.Value)
+}
+
+//在 goStage 启动的 goroutine 中 defer 调用
+//stage 的名字依次取 Named 的名字、拓扑结构中节点的名字和调用 goStage 的函数 pc 的名字
+func recoverStage(ctx context.Context, pc uintptr) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	rs := getRunState(ctx)
+	if rs == nil {
+		//既不在 Run 启动的 pipeline 中，也不是原始 pipeline 的 stage，没有地方报告错误，保持原来的行为
+		panic(r)
+	}
+	name := stageName(ctx)
+	if name == "" {
+		name = nodeName(ctx)
+	}
+	if name == "" {
+		name = shortFuncName(runtime.FuncForPC(pc).Name())
+	}
+	rs.recordError(&PanicError{Stage: name, Value: r, Stack: debug.Stack()})
+}
+
+//原始 pipeline 中 channel 到所在 pipeline 的 ctx 的对应关系
+//stage 构建时用输入的 channel 找到上游的运行状态，构建完成后登记自己输出的 channel，下游据此加入同一个运行状态
+//对应关系在被下游取走时删除，运行状态中所有的 goroutine 都退出之后，剩下的也会被删除
+//失败的运行状态保留对应关系，直到被下游取走，这样即使数据源已经失败退出，pipeline 也能拿到它的错误
+var pipeRuns = struct {
+	mu     sync.Mutex
+	byChan map[<-chan int]context.Context
+}{byChan: make(map[<-chan int]context.Context)}
+
+//原始 pipeline 的 stage 在构建时调用，返回 stage 使用的 ctx，数据源的 in 为 nil
+//in 是其他 stage 的输出时使用它所在的运行状态，否则开始一个新的运行状态
+//返回之后运行状态不会被清理，直到 pipeOutput 登记了 stage 的输出
+func pipeContext(in <-chan int) context.Context {
+	pipeRuns.mu.Lock()
+	ctx, ok := pipeRuns.byChan[in]
+	if ok && in != nil {
+		delete(pipeRuns.byChan, in)
+		getRunState(ctx).live.Add(1)
+	}
+	pipeRuns.mu.Unlock()
+	if ok && in != nil {
+		return ctx
+	}
+
+	ctx, rs := withRunState(context.Background())
+	rs.live.Add(1)
+	rs.onIdle = func() {
+		pipeRuns.mu.Lock()
+		defer pipeRuns.mu.Unlock()
+		//加锁之后可能已经有新的 stage 加入
+		if rs.live.Load() > 0 || rs.failed() {
+			return
+		}
+		for ch, c := range pipeRuns.byChan {
+			if getRunState(c) == rs {
+				delete(pipeRuns.byChan, ch)
+			}
+		}
+	}
+	return ctx
+}
+
+//登记 stage 输出的 channel，返回 out
+func pipeOutput(ctx context.Context, out <-chan int) <-chan int {
+	rs := getRunState(ctx)
+	pipeRuns.mu.Lock()
+	pipeRuns.byChan[out] = ctx
+	pipeRuns.mu.Unlock()
+	rs.release()
+	return out
+}
+
+func (rs *runState) failed() bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return len(rs.errs) > 0
+}
+
+//以 ctx 调用 fn：in 登记为 ctx 中的 channel，fn 中的原始 stage 会使用 ctx
+func callPipe(ctx context.Context, fn PipeFunc, in <-chan int) <-chan int {
+	pipeRuns.mu.Lock()
+	pipeRuns.byChan[in] = ctx
+	pipeRuns.mu.Unlock()
+	out := fn(in)
+	//fn 没有使用 pipeContext 时 in 不会被取走，输出由调用方负责登记
+	pipeRuns.mu.Lock()
+	delete(pipeRuns.byChan, in)
+	delete(pipeRuns.byChan, out)
+	pipeRuns.mu.Unlock()
+	return out
+}
+
+//把 Stage 适配为原始 pipeline 中的 PipeFunc
+//	pipeline(nums, echo, asPipeFunc(Parallel(4, ctxSquare, Ordered)), sum)
+func asPipeFunc(stage Stage[int, int]) PipeFunc {
+	return func(in <-chan int) <-chan int {
+		ctx := pipeContext(in)
+		//在 pipeline 中时，节点默认以适配器的函数命名，改为 stage 的名字，Named 和 Instrument 仍然可以覆盖
+		annotateNode(ctx, func(n *TopoNode, named *bool) {
+			if !*named {
+				n.Name = funcName(stage)
+			}
+		})
+		return pipeOutput(ctx, stage(ctx, in))
+	}
+}
+
+//把 PipeFunc 适配为 Stage，fn 中的原始 stage 使用 Stage 的 ctx
+func pipeStage(fn PipeFunc) Stage[int, int] {
+	return func(ctx context.Context, in <-chan int) <-chan int {
+		return callPipe(ctx, fn, in)
+	}
+}
+
+//和 pipeline 相同，同时返回这次调用的 Handle，用来等待 pipeline 结束，读取 stage 报告的错误，包括 panic
+//	out, h := pipelineWithHandle(nums, echo, square, sum)
+//	for n := range out { ... }
+//	if err := h.Wait(); err != nil { ... }
+func pipelineWithHandle(nums []int, echoFunc EchoFunc, pipeFuncs ...PipeFunc) (<-chan int, *Handle) {
+	src := echoFunc(nums)
+	//加入数据源的运行状态，数据源不是原始 stage 时开始一个新的运行状态
+	ctx := pipeContext(src)
+	rs := getRunState(ctx)
+	//构建完成之前运行状态不会被清理
+	defer rs.release()
+	return buildPipe(ctx, funcName(echoFunc), src, pipeFuncs), &Handle{state: rs}
+}
+
+//在 ctx 的运行状态中构建 pipeline，并记录它的拓扑结构
+func buildPipe(ctx context.Context, source string, src <-chan int, pipeFuncs []PipeFunc) <-chan int {
+	ch := traceNode(ctx, "source", source, nil, func(context.Context) <-chan int {
+		return src
+	})
+	for _, fn := range pipeFuncs {
+		in := ch
+		ch = traceNode(ctx, "stage", funcName(fn), []any{in}, func(ctx context.Context) <-chan int {
+			return callPipe(ctx, fn, in)
+		})
+	}
+	return ch
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+//Fan-out/Fan-in
+//一个 stage 只在一个 goroutine 中处理数据，计算密集的 stage 会成为瓶颈
+//Parallel 把同一个 stage 运行在 n 个 worker 上，再把它们的输出合并为一个 channel
+
+type MergeMode int
+
+const (
+	//按完成的先后顺序输出，速度最快
+	Unordered MergeMode = iota
+	//按输入的顺序输出，结果是确定的
+	Ordered
+)
+
+//在 n 个 worker 上并行运行 stage
+//stage 必须独立地处理每个元素，像 sum 这样的聚合 stage 并行之后只能得到 n 个部分结果
+func Parallel[A, B any](n int, stage Stage[A, B], mode MergeMode) Stage[A, B] {
+	if n < 1 {
+		n = 1
+	}
+	if mode == Ordered {
+		return orderedParallel(n, stage)
+	}
+
+	return func(ctx context.Context, in <-chan A) <-chan B {
+		annotateFanOut(ctx, n)
+		//n 个 stage 实例从同一个 channel 中读取数据
+		outs := make([]<-chan B, n)
+		for i := range outs {
+			outs[i] = stage(ctx, in)
+		}
+		return Merge(ctx, outs...)
+	}
+}
+
+type seqItem[T any] struct {
+	seq  int
+	item T
+}
+
+type seqResult[T any] struct {
+	seq    int
+	values []T
+}
+
+//保序的实现：为每个元素编号，每个元素单独经过一次 stage，
+//输出先放在重排缓冲区中，再按编号依次发送
+func orderedParallel[A, B any](n int, stage Stage[A, B]) Stage[A, B] {
+	return func(ctx context.Context, in <-chan A) <-chan B {
+		annotateFanOut(ctx, n)
+		jobs := make(chan seqItem[A])
+		results := make(chan seqResult[B])
+		//限制正在处理的元素个数，避免某个元素很慢时重排缓冲区无限增长
+		tokens := make(chan struct{}, 2*n)
+
+		goStage(ctx, func() {
+			defer close(jobs)
+			seq := 0
+			for v := range in {
+				select {
+				case tokens <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				if !send(ctx, jobs, seqItem[A]{seq, v}) {
+					return
+				}
+				seq++
+			}
+		})
+
+		var wg sync.WaitGroup
+		wg.Add(n)
+		for i := 0; i < n; i++ {
+			goStage(ctx, func() {
+				defer wg.Done()
+				for job := range jobs {
+					one := make(chan A, 1)
+					one <- job.item
+					close(one)
+
+					var values []B
+					for v := range stage(ctx, one) {
+						values = append(values, v)
+					}
+					if !send(ctx, results, seqResult[B]{job.seq, values}) {
+						return
+					}
+				}
+			})
+		}
+		goStage(ctx, func() {
+			wg.Wait()
+			close(results)
+		})
+
+		out := make(chan B)
+		goStage(ctx, func() {
+			defer close(out)
+			pending := make(map[int][]B)
+			next := 0
+			for res := range results {
+				pending[res.seq] = res.values
+				for {
+					values, ok := pending[next]
+					if !ok {
+						break
+					}
+					delete(pending, next)
+					next++
+					<-tokens
+					for _, v := range values {
+						if !send(ctx, out, v) {
+							return
+						}
+					}
+				}
+			}
+		})
+		return out
+	}
+}
+
+//	pipeline(nums, echo, ParallelPipe(4, square, Ordered), sum)
+func ParallelPipe(n int, fn PipeFunc, mode MergeMode) PipeFunc {
+	return asPipeFunc(Parallel(n, pipeStage(fn), mode))
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+//限流
+//下游的系统每秒只能接受 N 个元素时，在 pipeline 中加一个令牌桶：
+//桶中最多存放 burst 个令牌，每秒补充 rate 个，每个元素消耗一个令牌，没有令牌时等待
+//需要等待的元素放在一个按照到期时间排序的小顶堆中，不会阻塞上游，
+//按 key 限流时一个受限的 key 不会让其他 key 的元素等待，同一个 key 的元素按照到达的顺序输出
+//等待的元素达到 MaxPending 个时才会阻塞上游
+
+type rateConfig struct {
+	burst      int
+	maxPending int
+	stats      *RateStats
+}
+
+type RateOption func(*rateConfig)
+
+//桶的容量，也就是空闲之后可以连续通过的元素个数，默认为 1
+func Burst(n int) RateOption {
+	return func(c *rateConfig) {
+		c.burst = max(n, 1)
+	}
+}
+
+//最多有 n 个元素在等待令牌，超过时不再读取上游，默认为 1024
+//n 为 1 时和直接在 stage 中等待相同，元素严格按照到达的顺序输出
+func MaxPending(n int) RateOption {
+	return func(c *rateConfig) {
+		c.maxPending = max(n, 1)
+	}
+}
+
+//把每个元素等待的时间记录到 s 中
+func RecordWaits(s *RateStats) RateOption {
+	return func(c *rateConfig) {
+		c.stats = s
+	}
+}
+
+//元素因为限流而等待的时间
+type RateStats struct {
+	mu      sync.Mutex
+	count   int64
+	delayed int64
+	total   time.Duration
+	max     time.Duration
+}
+
+type RateSnapshot struct {
+	Count   int64 //通过的元素个数
+	Delayed int64 //需要等待的元素个数
+	Total   time.Duration
+	Max     time.Duration
+}
+
+func (s *RateStats) observe(wait time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.count++
+	if wait > 0 {
+		s.delayed++
+		s.total += wait
+		s.max = max(s.max, wait)
+	}
+}
+
+func (s *RateStats) Snapshot() RateSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return RateSnapshot{s.count, s.delayed, s.total, s.max}
+}
+
+//平均每个元素等待的时间
+func (s RateSnapshot) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Count)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+//按照经过的时间补充令牌
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = min(float64(burst), b.tokens+elapsed*rate)
+		b.last = now
+	}
+}
+
+//预定一个令牌，返回需要等待的时间
+//令牌可以预支为负数，等待的时间就是补充到 0 需要的时间，所以后续的元素会依次排队
+func (b *tokenBucket) reserve(now time.Time, rate float64, burst int) time.Duration {
+	b.refill(now, rate, burst)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+//每秒最多输出 rate 个元素，rate <= 0 时不限制
+func RateLimit[T any](rate float64, opts ...RateOption) Stage[T, T] {
+	return RateLimitBy(rate, func(T) struct{} { return struct{}{} }, opts...)
+}
+
+//等待令牌的元素
+type rateItem[T any, K comparable] struct {
+	due   time.Time
+	seq   int64
+	key   K
+	value T
+}
+
+//container/heap 需要的接口，按照到期时间排序，同时到期的按照到达的顺序
+type rateHeap[T any, K comparable] []rateItem[T, K]
+
+func (h rateHeap[T, K]) Len() int {
+	return len(h)
+}
+
+func (h rateHeap[T, K]) Less(i, j int) bool {
+	if !h[i].due.Equal(h[j].due) {
+		return h[i].due.Before(h[j].due)
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h rateHeap[T, K]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *rateHeap[T, K]) Push(x any) {
+	*h = append(*h, x.(rateItem[T, K]))
+}
+
+func (h *rateHeap[T, K]) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+//按照 key 分别限流，每个 key 有自己的令牌桶
+//同一个 key 后到的元素预定的令牌不会早于先到的，所以按照到期时间输出时同一个 key 的顺序不变
+func RateLimitBy[T any, K comparable](rate float64, key func(T) K, opts ...RateOption) Stage[T, T] {
+	cfg := rateConfig{burst: 1, maxPending: 1024}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	return func(ctx context.Context, in <-chan T) <-chan T {
+		out := make(chan T)
+		goStage(ctx, func() {
+			defer close(out)
+			clock := clockFrom(ctx)
+			buckets := make(map[K]*tokenBucket)
+			//每个 key 正在等待的元素个数
+			waiting := make(map[K]int)
+			pending := &rateHeap[T, K]{}
+			var seq int64
+			sweepAt := 1024
+
+			for in != nil || pending.Len() > 0 {
+				//输出已经到期的元素
+				if pending.Len() > 0 && !(*pending)[0].due.After(clock.Now()) {
+					item := heap.Pop(pending).(rateItem[T, K])
+					if waiting[item.key]--; waiting[item.key] == 0 {
+						delete(waiting, item.key)
+					}
+					if !send(ctx, out, item.value) {
+						return
+					}
+					continue
+				}
+
+				var recv <-chan T
+				if pending.Len() < cfg.maxPending {
+					recv = in
+				}
+				var timer Timer
+				var expired <-chan time.Time
+				if pending.Len() > 0 {
+					timer = clock.NewTimer((*pending)[0].due.Sub(clock.Now()))
+					expired = timer.C()
+				}
+
+				select {
+				case v, ok := <-recv:
+					if timer != nil {
+						timer.Stop()
+					}
+					if !ok {
+						in = nil
+						continue
+					}
+					if rate <= 0 {
+						if !send(ctx, out, v) {
+							return
+						}
+						continue
+					}
+
+					now := clock.Now()
+					k := key(v)
+					b, ok := buckets[k]
+					if !ok {
+						b = &tokenBucket{tokens: float64(cfg.burst), last: now}
+						buckets[k] = b
+					}
+					wait := b.reserve(now, rate, cfg.burst)
+					cfg.stats.observe(wait)
+
+					//令牌已经补满的桶和新建的桶没有区别，可以删除，避免 key 很多时 map 无限增长
+					if len(buckets) >= sweepAt {
+						for k, b := range buckets {
+							if b.refill(now, rate, cfg.burst); b.tokens >= float64(cfg.burst) && waiting[k] == 0 {
+								delete(buckets, k)
+							}
+						}
+						sweepAt = max(1024, 2*len(buckets))
+					}
+
+					if wait > 0 {
+						seq++
+						heap.Push(pending, rateItem[T, K]{now.Add(wait), seq, k, v})
+						waiting[k]++
+						continue
+					}
+					if !send(ctx, out, v) {
+						return
+					}
+				case <-expired:
+				case <-ctx.Done():
+					if timer != nil {
+						timer.Stop()
+					}
+					return
+				}
+			}
+		})
+		return out
+	}
+}
+
+//	pipeline(nums, echo, square, RateLimitPipe(100, Burst(10)), sum)
+func RateLimitPipe(rate float64, opts ...RateOption) PipeFunc {
+	return asPipeFunc(RateLimit[int](rate, opts...))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand/v2"
+	"time"
+)
+
+//失败重试和死信
+//TryMap 遇到错误会取消整个 pipeline，Retry 则会按照重试策略重新处理失败的元素，
+//重试之后仍然失败的元素连同错误一起发送到死信 channel 中，pipeline 继续运行
+
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Jitter      float64 //每次等待的时间随机减少的比例，取值 [0, 1]
+}
+
+//和 functional_options.go 一样，使用 functional options 配置重试策略
+type RetryOption func(*RetryPolicy)
+
+//最多尝试的次数，包括第一次
+func MaxAttempts(n int) RetryOption {
+	return func(p *RetryPolicy) {
+		p.MaxAttempts = n
+	}
+}
+
+//第 i 次重试前等待 base * 2^(i-1)，最多等待 maxDelay
+func Backoff(base, maxDelay time.Duration) RetryOption {
+	return func(p *RetryPolicy) {
+		p.BaseDelay = base
+		p.MaxDelay = maxDelay
+	}
+}
+
+func Jitter(f float64) RetryOption {
+	return func(p *RetryPolicy) {
+		p.Jitter = f
+	}
+}
+
+//第 attempt 次失败之后需要等待的时间
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		d -= time.Duration(float64(d) * p.Jitter * rand.Float64())
+	}
+	return d
+}
+
+//重试之后仍然失败的元素
+type DeadLetter[T any] struct {
+	Item     T
+	Err      error
+	Attempts int
+}
+
+//error 默认会被编码为 {}，这里编码为错误信息，便于用 JSONLinesSink 记录死信
+func (d DeadLetter[T]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Item     T      `json:"item"`
+		Err      string `json:"error"`
+		Attempts int    `json:"attempts"`
+	}{d.Item, d.Err.Error(), d.Attempts})
+}
+
+//对每个元素执行 fn，失败时按照重试策略重试
+//最终失败的元素发送到 dead 中，dead 为 nil 时作为错误报告并取消 pipeline
+//dead 需要由调用方读取，在 pipeline 结束之后由调用方关闭
+func Retry[A, B any](fn func(A) (B, error), dead chan<- DeadLetter[A], opts ...RetryOption) Stage[A, B] {
+	policy := RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    10 * time.Second,
+		Jitter:      0.2,
+	}
+	for _, opt := range opts {
+		opt(&policy)
+	}
+
+	return func(ctx context.Context, in <-chan A) <-chan B {
+		out := make(chan B)
+		goStage(ctx, func() {
+			defer close(out)
+			for v := range in {
+				res, attempts, err := retry(ctx, &policy, fn, v)
+				if ctx.Err() != nil {
+					return
+				}
+				if err == nil {
+					if !send(ctx, out, res) {
+						return
+					}
+					continue
+				}
+				if dead == nil {
+					ReportError(ctx, err)
+					return
+				}
+				if !send(ctx, dead, DeadLetter[A]{v, err, attempts}) {
+					return
+				}
+			}
+		})
+		return out
+	}
+}
+
+func retry[A, B any](ctx context.Context, policy *RetryPolicy, fn func(A) (B, error), v A) (B, int, error) {
+	var res B
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		res, err = fn(v)
+		if err == nil || attempt >= policy.MaxAttempts {
+			break
+		}
+
+		timer := clockFrom(ctx).NewTimer(policy.delay(attempt))
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return res, attempt, ctx.Err()
+		}
+	}
+	return res, attempt, err
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+//Pipeline 的终点
+//Sink 读取 pipeline 的输出并写入 io.Writer，返回写入的元素个数和遇到的错误
+//所有的 Sink 都带有缓冲，在输入结束时 flush
+
+type Sink[T any] func(in <-chan T) (int, error)
+
+//Format 决定元素以什么格式写入 w，返回写入一个元素的函数和 flush 缓冲的函数
+type Format[T any] func(w io.Writer) (write func(T) error, flush func() error)
+
+//每个元素写为一行，格式和 fmt.Println 相同
+func LinesFormat[T any]() Format[T] {
+	return func(w io.Writer) (func(T) error, func() error) {
+		bw := bufio.NewWriter(w)
+		write := func(v T) error {
+			_, err := fmt.Fprintln(bw, v)
+			return err
+		}
+		return write, bw.Flush
+	}
+}
+
+//每个元素通过 row 转换为 CSV 的一行，header 不为空时先写入表头
+func CSVFormat[T any](header []string, row func(T) []string) Format[T] {
+	return func(w io.Writer) (func(T) error, func() error) {
+		cw := csv.NewWriter(w)
+		//表头在第一次写入或 flush 时写入，没有任何元素时也会有表头
+		pending := header
+		writeHeader := func() error {
+			if pending == nil {
+				return nil
+			}
+			err := cw.Write(pending)
+			pending = nil
+			return err
+		}
+		write := func(v T) error {
+			if err := writeHeader(); err != nil {
+				return err
+			}
+			return cw.Write(row(v))
+		}
+		flush := func() error {
+			if err := writeHeader(); err != nil {
+				return err
+			}
+			cw.Flush()
+			return cw.Error()
+		}
+		return write, flush
+	}
+}
+
+//每个元素编码为一行 JSON（JSON Lines）
+func JSONLinesFormat[T any]() Format[T] {
+	return func(w io.Writer) (func(T) error, func() error) {
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		return func(v T) error { return enc.Encode(v) }, bw.Flush
+	}
+}
+
+//按照 format 把所有元素写入 w
+func WriterSink[T any](w io.Writer, format Format[T]) Sink[T] {
+	return func(in <-chan T) (int, error) {
+		write, flush := format(w)
+		n := 0
+		for v := range in {
+			if err := write(v); err != nil {
+				return n, err
+			}
+			n++
+		}
+		return n, flush()
+	}
+}
+
+func LinesSink[T any](w io.Writer) Sink[T] {
+	return WriterSink(w, LinesFormat[T]())
+}
+
+func CSVSink[T any](w io.Writer, header []string, row func(T) []string) Sink[T] {
+	return WriterSink(w, CSVFormat(header, row))
+}
+
+func JSONLinesSink[T any](w io.Writer) Sink[T] {
+	return WriterSink(w, JSONLinesFormat[T]())
+}
+
+//运行 pipeline 并把结果全部写入 sink，返回写入的个数
+//sink 写入失败时取消 pipeline，否则返回 pipeline 中 stage 报告的错误
+func RunTo[T any](ctx context.Context, f *Flow[T], sink Sink[T]) (int, error) {
+	out, h := f.Run(ctx)
+	n, err := sink(out)
+	if err != nil {
+		h.Stop()
+		return n, err
+	}
+	return n, h.Wait()
+}
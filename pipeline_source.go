@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//Pipeline 的数据源
+//echo 要求先把所有的输入放到切片中，下面这些数据源以流的方式产生数据
+//通过 AsEchoFunc 和 AsCtxEchoFunc 可以用在原来接收 EchoFunc 的地方
+
+//逐行读取 r，读取失败时报告错误
+//读取是阻塞的，pipeline 取消之后要等到下一行读取完成才会退出
+func ReaderLines(r io.Reader) Source[string] {
+	return func(ctx context.Context) <-chan string {
+		out := make(chan string)
+		goStage(ctx, func() {
+			defer close(out)
+			sendLines(ctx, r, out)
+		})
+		return out
+	}
+}
+
+func sendLines(ctx context.Context, r io.Reader, out chan<- string) bool {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if !send(ctx, out, scanner.Text()) {
+			return false
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		ReportError(ctx, err)
+		return false
+	}
+	return true
+}
+
+//按文件名的顺序逐行读取所有匹配 pattern 的文件
+func GlobLines(pattern string) Source[string] {
+	return func(ctx context.Context) <-chan string {
+		out := make(chan string)
+		goStage(ctx, func() {
+			defer close(out)
+			files, err := filepath.Glob(pattern)
+			if err != nil {
+				ReportError(ctx, err)
+				return
+			}
+			for _, name := range files {
+				if !sendFileLines(ctx, name, out) {
+					return
+				}
+			}
+		})
+		return out
+	}
+}
+
+func sendFileLines(ctx context.Context, name string, out chan<- string) bool {
+	file, err := os.Open(name)
+	if err != nil {
+		ReportError(ctx, err)
+		return false
+	}
+	defer file.Close()
+	return sendLines(ctx, file, out)
+}
+
+//每隔 d 产生一个当前时间，直到 pipeline 被取消
+//d 小于 minWindow 时按 minWindow 处理
+func TickerSource(d time.Duration) Source[time.Time] {
+	if d < minWindow {
+		d = minWindow
+	}
+	return func(ctx context.Context) <-chan time.Time {
+		out := make(chan time.Time)
+		goStage(ctx, func() {
+			defer close(out)
+			ticker := clockFrom(ctx).NewTicker(d)
+			defer ticker.Stop()
+			for {
+				select {
+				case t := <-ticker.C():
+					if !send(ctx, out, t) {
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+		return out
+	}
+}
+
+//不断调用 next 产生数据，直到 next 返回 false
+func Generate[T any](next func() (T, bool)) Source[T] {
+	return func(ctx context.Context) <-chan T {
+		out := make(chan T)
+		goStage(ctx, func() {
+			defer close(out)
+			for {
+				v, ok := next()
+				if !ok || !send(ctx, out, v) {
+					return
+				}
+			}
+		})
+		return out
+	}
+}
+
+//把一个 Flow 作为其他 pipeline 的数据源
+func (f *Flow[T]) Source() Source[T] {
+	return f.build
+}
+
+//把 Source 适配为 EchoFunc，传入的 nums 会被忽略
+//	pipeline(nil, AsEchoFunc(src), square, sum)
+func AsEchoFunc(src Source[int]) EchoFunc {
+	return func([]int) <-chan int {
+		ctx := pipeContext(nil)
+		return pipeOutput(ctx, src(ctx))
+	}
+}
+
+//把 Source 适配为 CtxEchoFunc，传入的 nums 会被忽略
+func AsCtxEchoFunc(src Source[int]) CtxEchoFunc {
+	return func(ctx context.Context, _ []int) <-chan int {
+		return src(ctx)
+	}
+}
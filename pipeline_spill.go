@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+//落盘的缓冲区
+//stage 之间的 channel 没有缓冲，一个慢的 stage 会让上游全部停下来，而内存中的缓冲区在进程崩溃时会丢失
+//Spill 在两个 stage 之间放一个队列：内存中的缓冲区满了之后，新的元素追加到本地目录的 segment 文件中，
+//下游读完一个 segment 之后删除它，磁盘占用达到上限时不再接收新的元素，上游等待
+//读取的位置定期保存在 cursor 文件中，重新打开同一个目录时，上次没有读完的 segment 会被重放
+//
+//注意：
+//1.只有已经落盘的元素可以重放，内存中的元素在崩溃或者取消时会丢失，MemoryItems(0) 让所有元素都经过磁盘
+//2.重放从最后一次保存的读取位置开始，下游可能会再次收到一部分元素
+//3.元素以 JSON 格式保存，T 需要可以被 encoding/json 编码和解码
+//4.一个 SpillQueue 同时只能被一个 pipeline 使用
+
+type spillConfig struct {
+	memItems    int
+	segmentSize int64
+	maxDisk     int64
+	cursorEvery int
+}
+
+type SpillOption func(*spillConfig)
+
+//内存中最多缓冲 n 个元素，默认 64
+func MemoryItems(n int) SpillOption {
+	return func(c *spillConfig) {
+		c.memItems = max(n, 0)
+	}
+}
+
+//一个 segment 文件超过 n 字节之后写入新的文件，默认 1MB
+func SegmentSize(n int64) SpillOption {
+	return func(c *spillConfig) {
+		c.segmentSize = n
+	}
+}
+
+//所有 segment 文件最多占用 n 字节，默认 64MB
+func MaxDiskBytes(n int64) SpillOption {
+	return func(c *spillConfig) {
+		c.maxDisk = n
+	}
+}
+
+type spillCursor struct {
+	Segment int   `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+//保存在一个目录中的队列
+type SpillQueue[T any] struct {
+	dir string
+	cfg spillConfig
+
+	mem []T
+	//磁盘上还没有读完的 segment，按照写入的顺序排列
+	segs []int
+	//可能在其他 goroutine 中通过 DiskBytes 读取
+	diskBytes atomic.Int64
+	//下一个 segment 的编号，编号一直递增，不会和 cursor 中记录的编号混淆
+	nextSeg int
+
+	w     *os.File
+	wsize int64
+
+	r     *os.File
+	rbuf  *bufio.Reader
+	rpos  spillCursor
+	reads int
+
+	//已经从磁盘读出、还没有发送给下游的元素
+	head     T
+	headSize int64
+	hasHead  bool
+}
+
+//打开 dir 中的队列，目录不存在时创建
+func OpenSpillQueue[T any](dir string, opts ...SpillOption) (*SpillQueue[T], error) {
+	cfg := spillConfig{memItems: 64, segmentSize: 1 << 20, maxDisk: 64 << 20, cursorEvery: 64}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	q := &SpillQueue[T]{dir: dir, cfg: cfg}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[int]int64)
+	for _, e := range entries {
+		id, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".seg"))
+		if err != nil || !strings.HasSuffix(e.Name(), ".seg") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		q.segs = append(q.segs, id)
+		sizes[id] = info.Size()
+	}
+	slices.Sort(q.segs)
+
+	data, err := os.ReadFile(q.cursorPath())
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &q.rpos); err != nil {
+			return nil, err
+		}
+	}
+	//cursor 之前的 segment 已经读完，只是还没有来得及删除
+	for len(q.segs) > 0 && q.segs[0] < q.rpos.Segment {
+		if err := os.Remove(q.segPath(q.segs[0])); err != nil {
+			return nil, err
+		}
+		q.segs = q.segs[1:]
+	}
+	if len(q.segs) == 0 || q.segs[0] != q.rpos.Segment {
+		q.rpos.Offset = 0
+	}
+	total := -q.rpos.Offset
+	for _, id := range q.segs {
+		total += sizes[id]
+	}
+	q.diskBytes.Store(total)
+	q.nextSeg = q.rpos.Segment + 1
+	if len(q.segs) > 0 {
+		q.nextSeg = max(q.nextSeg, q.segs[len(q.segs)-1]+1)
+	}
+	return q, nil
+}
+
+func (q *SpillQueue[T]) segPath(id int) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%09d.seg", id))
+}
+
+func (q *SpillQueue[T]) cursorPath() string {
+	return filepath.Join(q.dir, "cursor")
+}
+
+//磁盘上等待读取的字节数
+func (q *SpillQueue[T]) DiskBytes() int64 {
+	return q.diskBytes.Load()
+}
+
+func (q *SpillQueue[T]) full() bool {
+	return len(q.segs) > 0 && q.diskBytes.Load() >= q.cfg.maxDisk
+}
+
+//追加一个元素，磁盘上还有元素时也必须写入磁盘，保证先进先出
+func (q *SpillQueue[T]) push(v T) error {
+	if len(q.segs) == 0 && len(q.mem) < q.cfg.memItems {
+		q.mem = append(q.mem, v)
+		return nil
+	}
+
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if q.w != nil && q.wsize >= q.cfg.segmentSize {
+		if err := q.w.Close(); err != nil {
+			return err
+		}
+		q.w = nil
+	}
+	if q.w == nil {
+		//从上一次运行中留下的 segment 只读不写，末尾可能有不完整的记录
+		id := q.nextSeg
+		q.nextSeg++
+		f, err := os.OpenFile(q.segPath(id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+		if err != nil {
+			return err
+		}
+		q.w, q.wsize = f, 0
+		q.segs = append(q.segs, id)
+	}
+
+	record := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	record = append(record, payload...)
+	if _, err := q.w.Write(record); err != nil {
+		return err
+	}
+	q.wsize += int64(len(record))
+	q.diskBytes.Add(int64(len(record)))
+	return nil
+}
+
+//队列中最早的元素
+func (q *SpillQueue[T]) peek() (T, bool, error) {
+	if len(q.mem) > 0 {
+		return q.mem[0], true, nil
+	}
+	for !q.hasHead && len(q.segs) > 0 {
+		if err := q.readHead(); err != nil {
+			var zero T
+			return zero, false, err
+		}
+	}
+	return q.head, q.hasHead, nil
+}
+
+//从最早的 segment 中读出下一个元素，读到末尾时删除这个 segment
+func (q *SpillQueue[T]) readHead() error {
+	id := q.segs[0]
+	if q.r == nil {
+		f, err := os.Open(q.segPath(id))
+		if err != nil {
+			return err
+		}
+		if q.rpos.Segment != id {
+			q.rpos = spillCursor{id, 0}
+		}
+		if _, err := f.Seek(q.rpos.Offset, io.SeekStart); err != nil {
+			f.Close()
+			return err
+		}
+		q.r, q.rbuf = f, bufio.NewReader(f)
+	}
+
+	var size [4]byte
+	_, err := io.ReadFull(q.rbuf, size[:])
+	if err == nil {
+		payload := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err = io.ReadFull(q.rbuf, payload); err == nil {
+			var v T
+			if err := json.Unmarshal(payload, &v); err != nil {
+				return err
+			}
+			q.head, q.headSize, q.hasHead = v, int64(4+len(payload)), true
+			return nil
+		}
+	}
+	if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+
+	//这个 segment 已经读完，不完整的记录是崩溃时没有写完的，一起丢弃
+	//正在写入的 segment 读完说明磁盘上已经没有元素了，下次写入新的 segment
+	q.r.Close()
+	q.r, q.rbuf = nil, nil
+	if len(q.segs) == 1 && q.w != nil {
+		q.w.Close()
+		q.w = nil
+	}
+	if info, err := os.Stat(q.segPath(id)); err == nil {
+		q.diskBytes.Add(q.rpos.Offset - info.Size())
+	}
+	if err := os.Remove(q.segPath(id)); err != nil {
+		return err
+	}
+	q.segs = q.segs[1:]
+	if len(q.segs) > 0 {
+		q.rpos = spillCursor{q.segs[0], 0}
+	}
+	return nil
+}
+
+//删除 peek 返回的元素
+func (q *SpillQueue[T]) pop() error {
+	if len(q.mem) > 0 {
+		var zero T
+		q.mem[0] = zero
+		q.mem = q.mem[1:]
+		return nil
+	}
+	var zero T
+	q.head, q.hasHead = zero, false
+	q.rpos.Offset += q.headSize
+	q.diskBytes.Add(-q.headSize)
+	q.reads++
+	if q.reads%q.cfg.cursorEvery == 0 {
+		return q.saveCursor()
+	}
+	return nil
+}
+
+//保存读取的位置，和 checkpoint 一样先写临时文件再重命名
+func (q *SpillQueue[T]) saveCursor() error {
+	data, err := json.Marshal(q.rpos)
+	if err != nil {
+		return err
+	}
+	tmp := q.cursorPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.cursorPath())
+}
+
+//保存读取的位置并关闭文件，下次运行时从这里继续
+func (q *SpillQueue[T]) close() error {
+	err := q.saveCursor()
+	if q.r != nil {
+		q.r.Close()
+		q.r, q.rbuf = nil, nil
+	}
+	if q.w != nil {
+		if cerr := q.w.Close(); err == nil {
+			err = cerr
+		}
+		q.w = nil
+	}
+	return err
+}
+
+//在两个 stage 之间加入落盘的队列 q
+//先输出 q 中上次运行没有读完的元素，再输出 in 中的元素
+func Spill[T any](q *SpillQueue[T]) Stage[T, T] {
+	return func(ctx context.Context, in <-chan T) <-chan T {
+		out := make(chan T)
+		goStage(ctx, func() {
+			defer close(out)
+			defer func() {
+				if err := q.close(); err != nil {
+					ReportError(ctx, err)
+				}
+			}()
+
+			for {
+				next, ok, err := q.peek()
+				if err != nil {
+					ReportError(ctx, err)
+					return
+				}
+				var outCh chan<- T
+				if ok {
+					outCh = out
+				}
+				//磁盘占满时不再接收，上游等待下游读取
+				inCh := in
+				if q.full() {
+					inCh = nil
+				}
+				if inCh == nil && outCh == nil {
+					return
+				}
+
+				select {
+				case v, open := <-inCh:
+					if !open {
+						in = nil
+						continue
+					}
+					if err := q.push(v); err != nil {
+						ReportError(ctx, err)
+						return
+					}
+				case outCh <- next:
+					if err := q.pop(); err != nil {
+						ReportError(ctx, err)
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+		return out
+	}
+}
+
+//	pipeline(nums, echo, square, SpillPipe(q), sum)
+func SpillPipe(q *SpillQueue[int]) PipeFunc {
+	return asPipeFunc(Spill(q))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//和时间相关的数据流操作
+//	Debounce：元素停止到达 d 时间之后，只输出最后一个
+//	Throttle：每 d 时间最多输出一个元素，输出每段时间内的第一个
+//	Sample：每隔 d 输出这段时间内最新的元素
+//	TimeoutMap：处理一个元素超过 d 时间就放弃，丢弃这个元素或者让 pipeline 失败
+//都使用 ctx 中的时钟，可以用 helpers_test.go 中的 FakeClock 测试
+
+//只在安静 d 时间之后输出最后到达的元素，输入结束时立即输出还没有输出的元素
+func Debounce[T any](d time.Duration) Stage[T, T] {
+	return func(ctx context.Context, in <-chan T) <-chan T {
+		out := make(chan T)
+		goStage(ctx, func() {
+			defer close(out)
+			clock := clockFrom(ctx)
+
+			var timer Timer
+			var fire <-chan time.Time
+			defer func() {
+				if timer != nil {
+					timer.Stop()
+				}
+			}()
+
+			var pending T
+			for {
+				select {
+				case v, ok := <-in:
+					if !ok {
+						if fire != nil && ctx.Err() == nil {
+							send(ctx, out, pending)
+						}
+						return
+					}
+					//每个新的元素都重新开始计时
+					pending = v
+					if timer != nil {
+						timer.Stop()
+					}
+					timer = clock.NewTimer(d)
+					fire = timer.C()
+				case <-fire:
+					fire = nil
+					if !send(ctx, out, pending) {
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+		return out
+	}
+}
+
+//每 d 时间最多输出一个元素，距离上一次输出不足 d 的元素会被丢弃
+func Throttle[T any](d time.Duration) Stage[T, T] {
+	return func(ctx context.Context, in <-chan T) <-chan T {
+		out := make(chan T)
+		goStage(ctx, func() {
+			defer close(out)
+			clock := clockFrom(ctx)
+			var last time.Time
+			emitted := false
+			for v := range in {
+				now := clock.Now()
+				if emitted && now.Sub(last) < d {
+					continue
+				}
+				last, emitted = now, true
+				if !send(ctx, out, v) {
+					return
+				}
+			}
+		})
+		return out
+	}
+}
+
+//每隔 d 输出这段时间内最后到达的元素，这段时间内没有新元素时不输出
+//输入结束时，最后一段不完整的时间内的元素不会输出
+//和时间窗口一样，d 小于 minWindow 时按 minWindow 处理
+func Sample[T any](d time.Duration) Stage[T, T] {
+	if d < minWindow {
+		d = minWindow
+	}
+	return func(ctx context.Context, in <-chan T) <-chan T {
+		out := make(chan T)
+		goStage(ctx, func() {
+			defer close(out)
+			ticker := clockFrom(ctx).NewTicker(d)
+			defer ticker.Stop()
+
+			var latest T
+			fresh := false
+			for {
+				select {
+				case v, ok := <-in:
+					if !ok {
+						return
+					}
+					latest, fresh = v, true
+				case <-ticker.C():
+					if !fresh {
+						continue
+					}
+					fresh = false
+					if !send(ctx, out, latest) {
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+		return out
+	}
+}
+
+var ErrItemTimeout = errors.New("item timed out")
+
+type TimeoutMode int
+
+const (
+	//丢弃超时的元素，pipeline 继续运行
+	DropOnTimeout TimeoutMode = iota
+	//报告 ErrItemTimeout，取消整个 pipeline
+	FailOnTimeout
+)
+
+//用 fn 处理每个元素，每个元素最多处理 d 时间
+//超时之后传给 fn 的 ctx 会被取消，fn 应该尽快返回，fn 返回的错误和 TryMap 一样会取消 pipeline
+func TimeoutMap[A, B any](d time.Duration, fn func(context.Context, A) (B, error), mode TimeoutMode) Stage[A, B] {
+	type result struct {
+		value B
+		err   error
+	}
+
+	return func(ctx context.Context, in <-chan A) <-chan B {
+		out := make(chan B)
+		goStage(ctx, func() {
+			defer close(out)
+			clock := clockFrom(ctx)
+
+			for v := range in {
+				itemCtx, cancel := context.WithCancel(ctx)
+				//有缓冲，超时之后 fn 返回时不会阻塞
+				done := make(chan result, 1)
+				goStage(ctx, func() {
+					res, err := fn(itemCtx, v)
+					done <- result{res, err}
+				})
+
+				timer := clock.NewTimer(d)
+				var res result
+				timedOut := false
+				select {
+				case res = <-done:
+				case <-timer.C():
+					timedOut = true
+				case <-ctx.Done():
+				}
+				timer.Stop()
+				cancel()
+
+				switch {
+				case ctx.Err() != nil:
+					return
+				case timedOut && mode == DropOnTimeout:
+					continue
+				case timedOut:
+					ReportError(ctx, fmt.Errorf("%w after %v: %v", ErrItemTimeout, d, v))
+					return
+				case res.err != nil:
+					ReportError(ctx, res.err)
+					return
+				}
+				if !send(ctx, out, res.value) {
+					return
+				}
+			}
+		})
+		return out
+	}
+}
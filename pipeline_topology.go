@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+//Pipeline 的拓扑结构
+//Flow 在构建时把每个数据源、stage 以及 Broadcast、MergeFlows、Join 记录为一个节点，
+//节点之间的边根据 channel 的连接关系得到，Named、Parallel、Instrument 会补充节点的名字、并行度和指标
+//通过 Handle.Topology 读取正在运行的 pipeline 的结构，或者用 Describe 只构建不运行，再用 WriteDOT 输出为 Graphviz 格式：
+//	Describe(flow).WriteDOT(os.Stdout, nil)
+//	go run pipeline*.go | dot -Tsvg > pipeline.svg
+
+type TopoNode struct {
+	ID      int
+	Kind    string //source、stage、broadcast、merge、join
+	Name    string
+	FanOut  int    //Parallel 的 worker 个数或者 Broadcast 的分支个数
+	Buffer  int    //输出 channel 的容量
+	Metrics string //Instrument 使用的名字，用来在 WriteDOT 中查找指标
+}
+
+type TopoEdge struct {
+	From, To int
+}
+
+type Topology struct {
+	Nodes []TopoNode
+	Edges []TopoEdge
+}
+
+//一次运行中记录拓扑结构
+type topoRecorder struct {
+	mu    sync.Mutex
+	topo  Topology
+	named []bool
+	//channel 是由哪个节点输出的
+	byChan map[any]int
+}
+
+type topoFrameKey struct{}
+
+func (rs *runState) topology() *topoRecorder {
+	if rs == nil {
+		return nil
+	}
+	return rs.topo
+}
+
+//开始构建一个节点，ins 是它的输入 channel，返回的 ctx 用于构建这个节点
+//不在 Run 启动的 pipeline 中时 rec 为 nil
+func beginNode(ctx context.Context, kind, name string, ins ...any) (context.Context, *topoRecorder, int) {
+	ctx = markNode(ctx, kind)
+	rec := getRunState(ctx).topology()
+	if rec == nil {
+		return ctx, nil, 0
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	id := len(rec.topo.Nodes)
+	rec.topo.Nodes = append(rec.topo.Nodes, TopoNode{ID: id, Kind: kind, Name: name, FanOut: 1})
+	rec.named = append(rec.named, false)
+	for _, in := range ins {
+		if from, ok := rec.byChan[in]; ok {
+			rec.topo.Edges = append(rec.topo.Edges, TopoEdge{from, id})
+		}
+	}
+	return context.WithValue(ctx, topoFrameKey{}, id), rec, id
+}
+
+//记录节点 id 输出的 channel
+//out 已经是其他节点的输出时，例如把一个 Flow 作为数据源，在两个节点之间连一条边
+func (rec *topoRecorder) output(id int, out any, buffer int) {
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if from, ok := rec.byChan[out]; ok && from != id {
+		rec.topo.Edges = append(rec.topo.Edges, TopoEdge{from, id})
+	}
+	rec.byChan[out] = id
+	rec.topo.Nodes[id].Buffer = buffer
+}
+
+func (rec *topoRecorder) snapshot() *Topology {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return &Topology{
+		Nodes: append([]TopoNode(nil), rec.topo.Nodes...),
+		Edges: append([]TopoEdge(nil), rec.topo.Edges...),
+	}
+}
+
+//构建一个只有一个输出的节点
+func traceNode[T any](ctx context.Context, kind, name string, ins []any, build func(context.Context) <-chan T) <-chan T {
+	ctx, rec, id := beginNode(ctx, kind, name, ins...)
+	out := build(ctx)
+	rec.output(id, out, cap(out))
+	return out
+}
+
+//修改 ctx 所在的节点，多层包装时外层的设置优先
+func annotateNode(ctx context.Context, fn func(n *TopoNode, named *bool)) {
+	rec := getRunState(ctx).topology()
+	id, ok := ctx.Value(topoFrameKey{}).(int)
+	if rec == nil || !ok {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	fn(&rec.topo.Nodes[id], &rec.named[id])
+}
+
+//ctx 所在节点的名字，不在节点中时返回空字符串
+func nodeName(ctx context.Context) string {
+	rec := getRunState(ctx).topology()
+	id, ok := ctx.Value(topoFrameKey{}).(int)
+	if rec == nil || !ok {
+		return ""
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.topo.Nodes[id].Name
+}
+
+func annotateName(ctx context.Context, name string) {
+	annotateNode(ctx, func(n *TopoNode, named *bool) {
+		if !*named {
+			n.Name, *named = name, true
+		}
+	})
+}
+
+func annotateFanOut(ctx context.Context, fanOut int) {
+	annotateNode(ctx, func(n *TopoNode, _ *bool) {
+		if n.FanOut == 1 {
+			n.FanOut = fanOut
+		}
+	})
+}
+
+//函数的名字，用作没有命名的节点的名字
+//	main.square -> square
+//	main.MapStage[...].func1 -> MapStage
+func funcName(fn any) string {
+	f := runtime.FuncForPC(reflect.ValueOf(fn).Pointer())
+	if f == nil {
+		return "?"
+	}
+	return shortFuncName(f.Name())
+}
+
+func shortFuncName(name string) string {
+	if i := strings.Index(name, "["); i >= 0 {
+		name = name[:i]
+	}
+	//去掉包名
+	name = name[strings.LastIndex(name, "/")+1:]
+	name = name[strings.Index(name, ".")+1:]
+	if i := strings.Index(name, ".func"); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+//正在运行的 pipeline 的拓扑结构
+func (h *Handle) Topology() *Topology {
+	return h.state.topo.snapshot()
+}
+
+//只构建 f 而不运行，返回它的拓扑结构
+//构建时不会启动任何 goroutine，数据源不会读取数据
+func Describe[T any](f *Flow[T]) *Topology {
+	ctx, rs := withRunState(context.Background())
+	rs.describe = true
+	f.build(ctx)
+	rs.cancel()
+	return rs.topo.snapshot()
+}
+
+//描述 pipeline.go 中由 pipeline(nums, echoFunc, pipeFuncs...) 组成的 pipeline
+//和 Describe 一样只构建不运行：不会调用 echoFunc，pipeFuncs 以一个已经关闭的 channel 为输入构建，
+//其中的原始 stage 和 *Pipe 适配器不会启动 goroutine，ParallelPipe、InstrumentPipe 等会记录并行度和指标的名字
+func DescribePipeline(echoFunc EchoFunc, pipeFuncs ...PipeFunc) *Topology {
+	ctx, rs := withRunState(context.Background())
+	rs.describe = true
+	src := make(chan int)
+	close(src)
+	buildPipe(ctx, funcName(echoFunc), src, pipeFuncs)
+	rs.cancel()
+	return rs.topo.snapshot()
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+//以 Graphviz DOT 格式输出拓扑结构，m 不为 nil 时在节点上标注 Instrument 统计的指标
+func (t *Topology) WriteDOT(w io.Writer, m *Metrics) error {
+	snaps := make(map[string]StageSnapshot)
+	if m != nil {
+		for _, s := range m.Snapshot() {
+			snaps[s.Name] = s
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("digraph pipeline {\n\trankdir=LR;\n")
+	for _, n := range t.Nodes {
+		label := n.Name
+		if n.FanOut > 1 {
+			label += fmt.Sprintf(" ×%d", n.FanOut)
+		}
+		if s, ok := snaps[n.Metrics]; ok && n.Metrics != "" {
+			label += fmt.Sprintf("\nin=%d out=%d queue=%d/%d", s.In, s.Out, s.QueueLen, s.QueueCap)
+		}
+		shape := "box"
+		switch n.Kind {
+		case "source":
+			shape = "ellipse"
+		case "broadcast", "merge", "join":
+			shape = "diamond"
+		}
+		fmt.Fprintf(&b, "\tn%d [label=\"%s\", shape=%s];\n", n.ID, dotEscaper.Replace(label), shape)
+	}
+	for _, e := range t.Edges {
+		fmt.Fprintf(&b, "\tn%d -> n%d", e.From, e.To)
+		if buf := t.Nodes[e.From].Buffer; buf > 0 {
+			fmt.Fprintf(&b, " [label=\"buffer=%d\"]", buf)
+		}
+		b.WriteString(";\n")
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
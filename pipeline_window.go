@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+//窗口聚合
+//sum 要等输入全部结束才会输出，对于无限的数据流没有意义
+//窗口 stage 把数据流切分为一个个窗口，每个窗口输出一次聚合结果
+//滚动窗口之间互不重叠，滑动窗口每隔 step 输出一次最近 size 范围内的结果
+//输入结束时，最后一个不完整的窗口也会输出，空窗口不会输出
+
+func reduceAll[T, R any](items []T, zero R, fn func(R, T) R) R {
+	acc := zero
+	for _, v := range items {
+		acc = fn(acc, v)
+	}
+	return acc
+}
+
+//每 size 个元素输出一次
+func TumblingCount[T, R any](size int, zero R, fn func(R, T) R) Stage[T, R] {
+	return SlidingCount(size, size, zero, fn)
+}
+
+//保留最近的 size 个元素，每 step 个元素输出一次
+func SlidingCount[T, R any](size, step int, zero R, fn func(R, T) R) Stage[T, R] {
+	if size < 1 {
+		size = 1
+	}
+	if step < 1 {
+		step = 1
+	}
+	return func(ctx context.Context, in <-chan T) <-chan R {
+		out := make(chan R)
+		goStage(ctx, func() {
+			defer close(out)
+			var window []T
+			fresh := 0
+			for v := range in {
+				window = append(window, v)
+				if len(window) > size {
+					window = window[len(window)-size:]
+				}
+				fresh++
+				if fresh == step {
+					fresh = 0
+					if !send(ctx, out, reduceAll(window, zero, fn)) {
+						return
+					}
+					//step 不小于 size 时，当前窗口的元素不会再出现在后面的窗口中
+					if step >= size {
+						window = window[:0]
+					}
+				}
+			}
+			if fresh > 0 && ctx.Err() == nil {
+				send(ctx, out, reduceAll(window, zero, fn))
+			}
+		})
+		return out
+	}
+}
+
+//每隔 d 输出一次这段时间内的结果
+func TumblingTime[T, R any](d time.Duration, zero R, fn func(R, T) R) Stage[T, R] {
+	return SlidingTime(d, d, zero, fn)
+}
+
+type timedItem[T any] struct {
+	at   time.Time
+	item T
+}
+
+//时间窗口的最小长度，和 SlidingCount 一样，不合法的 size 和 step 按最小值处理
+const minWindow = time.Millisecond
+
+//每隔 step 输出一次最近 size 时间内的结果
+func SlidingTime[T, R any](size, step time.Duration, zero R, fn func(R, T) R) Stage[T, R] {
+	if size < minWindow {
+		size = minWindow
+	}
+	if step < minWindow {
+		step = minWindow
+	}
+	return func(ctx context.Context, in <-chan T) <-chan R {
+		out := make(chan R)
+		goStage(ctx, func() {
+			defer close(out)
+			clock := clockFrom(ctx)
+			ticker := clock.NewTicker(step)
+			defer ticker.Stop()
+
+			var window []timedItem[T]
+			//上次输出之后是否有新的元素，输入结束时据此决定是否输出最后一个窗口
+			fresh := false
+			emit := func(now time.Time) bool {
+				//丢弃已经滑出窗口的元素，滚动窗口在每次输出后清空即可，不需要按时间比较
+				if size != step {
+					i := 0
+					for i < len(window) && !window[i].at.After(now.Add(-size)) {
+						i++
+					}
+					window = window[i:]
+				}
+				if len(window) == 0 {
+					return true
+				}
+				fresh = false
+				acc := zero
+				for _, ti := range window {
+					acc = fn(acc, ti.item)
+				}
+				if step >= size {
+					window = window[:0]
+				}
+				return send(ctx, out, acc)
+			}
+
+			for {
+				select {
+				case v, ok := <-in:
+					if !ok {
+						if fresh && ctx.Err() == nil {
+							emit(clock.Now())
+						}
+						return
+					}
+					window = append(window, timedItem[T]{clock.Now(), v})
+					fresh = true
+				case now := <-ticker.C():
+					if !emit(now) {
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+		return out
+	}
+}
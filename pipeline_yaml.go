@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//一个只支持 YAML 子集的解析器，足够用来描述 pipeline
+//支持块状的 map 和列表、[a, b] 和 {k: v} 形式的行内写法、引号字符串、数字、布尔值、null 和 # 注释
+//不支持锚点、多行字符串、多文档等特性
+//解析的结果和 encoding/json 解码到 any 的结构相同：map[string]any、[]any 和标量
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func parseYAML(src string) (any, error) {
+	p := &yamlParser{}
+	for i, raw := range strings.Split(src, "\n") {
+		text := stripYAMLComment(strings.TrimRight(raw, " \t\r"))
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("yaml line %d: tabs are not allowed for indentation", i+1)
+		}
+		p.lines = append(p.lines, yamlLine{i + 1, len(text) - len(trimmed), trimmed})
+	}
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+
+	v, err := p.parseBlock(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("yaml line %d: unexpected indentation", p.lines[p.pos].num)
+	}
+	return v, nil
+}
+
+//去掉不在引号中的 # 注释
+func stripYAMLComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' '):
+			return strings.TrimRight(s[:i], " ")
+		}
+	}
+	return s
+}
+
+func isYAMLSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (p *yamlParser) parseBlock(indent int) (any, error) {
+	if isYAMLSeqItem(p.lines[p.pos].text) {
+		return p.parseSeq(indent)
+	}
+	return p.parseMap(indent)
+}
+
+func (p *yamlParser) parseSeq(indent int) (any, error) {
+	list := []any{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent != indent || !isYAMLSeqItem(line.text) {
+			break
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+		if rest == "" {
+			p.pos++
+			v, err := p.parseNested(indent)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+			continue
+		}
+
+		//"- key: value" 和 "- - item" 是嵌套的 map 或列表的开始，把它当作一行缩进更深的块解析
+		if _, _, ok := splitYAMLKey(rest); ok || isYAMLSeqItem(rest) {
+			p.lines[p.pos] = yamlLine{line.num, line.indent + len(line.text) - len(rest), rest}
+			v, err := p.parseBlock(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+			continue
+		}
+
+		v, err := parseYAMLValue(rest, line.num)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+		p.pos++
+	}
+	return list, nil
+}
+
+func (p *yamlParser) parseMap(indent int) (any, error) {
+	m := map[string]any{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("yaml line %d: unexpected indentation", line.num)
+		}
+		if isYAMLSeqItem(line.text) {
+			break
+		}
+
+		key, rest, ok := splitYAMLKey(line.text)
+		if !ok {
+			return nil, fmt.Errorf("yaml line %d: expected \"key: value\"", line.num)
+		}
+		if _, dup := m[key]; dup {
+			return nil, fmt.Errorf("yaml line %d: duplicate key %q", line.num, key)
+		}
+		p.pos++
+		if rest != "" {
+			v, err := parseYAMLValue(rest, line.num)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+			continue
+		}
+
+		//值在下面的行中，列表可以和 key 保持相同的缩进
+		if p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isYAMLSeqItem(p.lines[p.pos].text) {
+			v, err := p.parseSeq(indent)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+			continue
+		}
+		v, err := p.parseNested(indent)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+//解析缩进比 indent 更深的块，没有这样的块时值为 null
+func (p *yamlParser) parseNested(indent int) (any, error) {
+	if p.pos >= len(p.lines) || p.lines[p.pos].indent <= indent {
+		return nil, nil
+	}
+	return p.parseBlock(p.lines[p.pos].indent)
+}
+
+//把 "key: value" 拆分为 key 和 value，冒号后面必须是空格或者行尾
+func splitYAMLKey(text string) (string, string, bool) {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			return "", "", false
+		case c == ':' && (i+1 == len(text) || text[i+1] == ' '):
+			key, err := parseYAMLScalar(strings.TrimSpace(text[:i]), 0)
+			if err != nil {
+				return "", "", false
+			}
+			return fmt.Sprint(key), strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+//解析一行中的值，可以是行内的列表、map 或者标量
+func parseYAMLValue(text string, num int) (any, error) {
+	text = strings.TrimSpace(text)
+	switch {
+	case strings.HasPrefix(text, "["):
+		if !strings.HasSuffix(text, "]") {
+			return nil, fmt.Errorf("yaml line %d: unterminated list", num)
+		}
+		items, err := splitYAMLFlow(text[1:len(text)-1], num)
+		if err != nil {
+			return nil, err
+		}
+		list := make([]any, 0, len(items))
+		for _, item := range items {
+			v, err := parseYAMLValue(item, num)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case strings.HasPrefix(text, "{"):
+		if !strings.HasSuffix(text, "}") {
+			return nil, fmt.Errorf("yaml line %d: unterminated map", num)
+		}
+		items, err := splitYAMLFlow(text[1:len(text)-1], num)
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[string]any, len(items))
+		for _, item := range items {
+			key, rest, ok := splitYAMLKey(item)
+			if !ok {
+				return nil, fmt.Errorf("yaml line %d: expected \"key: value\" in %q", num, item)
+			}
+			v, err := parseYAMLValue(rest, num)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+		}
+		return m, nil
+	}
+	return parseYAMLScalar(text, num)
+}
+
+//按照最外层的逗号拆分行内列表或 map 的内容
+func splitYAMLFlow(text string, num int) ([]string, error) {
+	var items []string
+	var quote byte
+	depth, start := 0, 0
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		case c == ',' && depth == 0:
+			items = append(items, strings.TrimSpace(text[start:i]))
+			start = i + 1
+		}
+	}
+	if quote != 0 || depth != 0 {
+		return nil, fmt.Errorf("yaml line %d: unbalanced brackets or quotes", num)
+	}
+	if last := strings.TrimSpace(text[start:]); last != "" {
+		items = append(items, last)
+	}
+	return items, nil
+}
+
+func parseYAMLScalar(text string, num int) (any, error) {
+	switch {
+	case strings.HasPrefix(text, `"`):
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, fmt.Errorf("yaml line %d: bad string %s", num, text)
+		}
+		return s, nil
+	case strings.HasPrefix(text, "'"):
+		if len(text) < 2 || !strings.HasSuffix(text, "'") {
+			return nil, fmt.Errorf("yaml line %d: bad string %s", num, text)
+		}
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	}
+
+	switch text {
+	case "", "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if n, err := strconv.Atoi(text); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(text, 64); err == nil {
+		return f, nil
+	}
+	return text, nil
+}
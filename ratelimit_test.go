@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+//受限的 key 不会让其他 key 的元素等待，同一个 key 的元素按照到达的顺序输出
+func TestRateLimitByKey(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		stage := RateLimitBy(1, func(s string) byte { return s[0] })
+		h := NewStageHarness(t, stage, Synchronous())
+		h.Send("a1", "a2", "a3", "b1")
+		h.Advance(time.Second)
+		h.Send("b2")
+		h.Advance(time.Second)
+		ExpectEmissions(t, h.Close(),
+			Emission[string]{"a1", 0},
+			Emission[string]{"b1", 0},
+			Emission[string]{"a2", time.Second},
+			Emission[string]{"b2", time.Second},
+			Emission[string]{"a3", 2 * time.Second},
+		)
+	})
+}
+
+//等待的元素达到 MaxPending 个时阻塞上游，b1 要等 a3 进入等待队列之后才能被读取
+func TestRateLimitMaxPending(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		stage := RateLimitBy(1, func(s string) byte { return s[0] }, MaxPending(1))
+		h := NewStageHarness(t, stage, Synchronous())
+		h.SendAsync("a1", "a2", "a3", "b1")
+		h.Advance(time.Second)
+		h.Advance(time.Second)
+		ExpectEmissions(t, h.Close(),
+			Emission[string]{"a1", 0},
+			Emission[string]{"a2", time.Second},
+			Emission[string]{"a3", 2 * time.Second},
+			Emission[string]{"b1", 2 * time.Second},
+		)
+	})
+}
+
+//输入结束时等待中的元素仍然按时输出
+func TestRateLimitFlush(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		h := NewStageHarness(t, RateLimit[int](2, Burst(2)), Synchronous())
+		h.Send(1, 2, 3, 4)
+		closed := make(chan []Emission[int])
+		go func() { closed <- h.Close() }()
+		synctest.Wait()
+		h.Advance(500 * time.Millisecond)
+		h.Advance(500 * time.Millisecond)
+		ExpectEmissions(t, <-closed,
+			Emission[int]{1, 0},
+			Emission[int]{2, 0},
+			Emission[int]{3, 500 * time.Millisecond},
+			Emission[int]{4, time.Second},
+		)
+	})
+}
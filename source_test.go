@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+//d 不大于 0 时按 minWindow 处理，而不是让 NewTicker panic
+func TestTickerSourceNonPositive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	out, h := From(TickerSource(0)).Run(ctx)
+	for range 3 {
+		if _, ok := <-out; !ok {
+			t.Fatalf("ticker stopped: %v", h.Wait())
+		}
+	}
+	cancel()
+	drainCount(out)
+	if err := h.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
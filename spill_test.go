@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"testing/synctest"
+)
+
+func openSpill(t *testing.T, dir string, opts ...SpillOption) *SpillQueue[int] {
+	t.Helper()
+	q, err := OpenSpillQueue[int](dir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func pushAll(t *testing.T, q *SpillQueue[int], from, to int) {
+	t.Helper()
+	for i := from; i <= to; i++ {
+		if err := q.push(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+//读出 q 中最多 n 个元素，n < 0 时读完
+func popN(t *testing.T, q *SpillQueue[int], n int) []int {
+	t.Helper()
+	var got []int
+	for n < 0 || len(got) < n {
+		v, ok, err := q.peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		if err := q.pop(); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, v)
+	}
+	return got
+}
+
+func seq(from, to int) []int {
+	var s []int
+	for i := from; i <= to; i++ {
+		s = append(s, i)
+	}
+	return s
+}
+
+//一个整数在 segment 中占用的字节数
+func recordSize(n int) int64 {
+	return int64(4 + len(strconv.Itoa(n)))
+}
+
+func segFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+//Stop 之后重新打开，没有读完的元素按顺序重放，不会丢失也不会重复
+func TestSpillReplayAfterStop(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		dir := t.TempDir()
+		q := openSpill(t, dir, MemoryItems(0))
+		out, h := Then(From(FromSlice(seq(1, 500))), Spill(q)).Run(context.Background())
+		first := []int{<-out, <-out, <-out}
+		//等待上游的元素全部进入队列
+		synctest.Wait()
+		if err := h.Stop(); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(first, []int{1, 2, 3}) {
+			t.Fatalf("first run = %v", first)
+		}
+
+		//Stop 时保存了准确的读取位置，接着第一次运行继续
+		q = openSpill(t, dir, MemoryItems(0))
+		rest, err := Collect(context.Background(), Then(From(FromSlice[int](nil)), Spill(q)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(rest, seq(4, 500)) {
+			t.Fatalf("replayed %v, want 4..500", rest)
+		}
+		if files := segFiles(t, dir); len(files) != 0 {
+			t.Fatalf("segments left after replay: %v", files)
+		}
+	})
+}
+
+//崩溃时没有保存读取位置，从上一次保存的位置重放，重复的元素不超过保存的间隔
+func TestSpillReplayAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	q := openSpill(t, dir, MemoryItems(0))
+	pushAll(t, q, 1, 200)
+	got := popN(t, q, 100)
+	//模拟崩溃：不调用 close，读取位置停留在最后一次保存的地方
+	q.r.Close()
+	q.w.Close()
+
+	q = openSpill(t, dir, MemoryItems(0))
+	replayed := popN(t, q, -1)
+	if len(replayed) == 0 || replayed[len(replayed)-1] != 200 {
+		t.Fatalf("replay ended at %v, want 200", replayed)
+	}
+	start := replayed[0]
+	if !slices.Equal(replayed, seq(start, 200)) {
+		t.Fatalf("replay is not contiguous: %v", replayed)
+	}
+	if dup := len(got) - (start - 1); dup < 0 || dup > q.cfg.cursorEvery {
+		t.Fatalf("%d items replayed twice, want at most %d", dup, q.cfg.cursorEvery)
+	}
+	q.close()
+}
+
+//segment 写满之后换一个新的文件，读完的 segment 会被删除
+func TestSpillSegmentRotation(t *testing.T) {
+	dir := t.TempDir()
+	q := openSpill(t, dir, MemoryItems(0), SegmentSize(20))
+	pushAll(t, q, 1, 30)
+	files := segFiles(t, dir)
+	if len(files) < 5 {
+		t.Fatalf("%d segments, want several", len(files))
+	}
+
+	got := popN(t, q, 15)
+	if left := segFiles(t, dir); len(left) >= len(files) {
+		t.Fatalf("%d of %d segments left after reading half, want some deleted", len(left), len(files))
+	}
+	got = append(got, popN(t, q, -1)...)
+	if !slices.Equal(got, seq(1, 30)) {
+		t.Fatalf("got %v", got)
+	}
+	if left := segFiles(t, dir); len(left) != 0 {
+		t.Fatalf("segments left: %v", left)
+	}
+	if n := q.DiskBytes(); n != 0 {
+		t.Fatalf("DiskBytes = %d, want 0", n)
+	}
+	q.close()
+}
+
+//磁盘占满之后不再读取上游，下游读取之后继续
+func TestSpillBackPressure(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		dir := t.TempDir()
+		q := openSpill(t, dir, MemoryItems(0), MaxDiskBytes(30))
+		ctx, rs := withRunState(context.Background())
+		in := make(chan int)
+		out := Spill(q)(ctx, in)
+
+		var sent int
+		go func() {
+			defer close(in)
+			for i := 1; i <= 100; i++ {
+				in <- i
+				sent = i
+			}
+		}()
+		synctest.Wait()
+		if sent == 100 {
+			t.Fatal("upstream was never blocked")
+		}
+		if n := q.DiskBytes(); n < 30 || n > 30+recordSize(100) {
+			t.Fatalf("DiskBytes = %d while blocked, want the 30 byte cap", n)
+		}
+
+		var got []int
+		for v := range out {
+			got = append(got, v)
+		}
+		if !slices.Equal(got, seq(1, 100)) {
+			t.Fatalf("got %v", got)
+		}
+		rs.wg.Wait()
+	})
+}
+
+//崩溃时写了一半的记录在重放时被丢弃
+func TestSpillTruncatedRecord(t *testing.T) {
+	dir := t.TempDir()
+	q := openSpill(t, dir, MemoryItems(0))
+	pushAll(t, q, 1, 3)
+	if err := q.close(); err != nil {
+		t.Fatal(err)
+	}
+	files := segFiles(t, dir)
+	f, err := os.OpenFile(files[len(files)-1], os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//长度是 100，只写了 3 个字节
+	f.Write(append(binary.BigEndian.AppendUint32(nil, 100), "123"...))
+	f.Close()
+
+	q = openSpill(t, dir, MemoryItems(0))
+	if got := popN(t, q, -1); !slices.Equal(got, []int{1, 2, 3}) {
+		t.Fatalf("got %v, want [1 2 3]", got)
+	}
+	if left := segFiles(t, dir); len(left) != 0 {
+		t.Fatalf("segments left: %v", left)
+	}
+	if n := q.DiskBytes(); n != 0 {
+		t.Fatalf("DiskBytes = %d, want 0", n)
+	}
+	q.close()
+}
+
+//重新打开之后 DiskBytes 只计算还没有读取的记录
+func TestSpillDiskBytesAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	q := openSpill(t, dir, MemoryItems(0), SegmentSize(20))
+	pushAll(t, q, 1, 12)
+	popN(t, q, 5)
+	if err := q.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var want int64
+	for i := 6; i <= 12; i++ {
+		want += recordSize(i)
+	}
+	q = openSpill(t, dir, MemoryItems(0), SegmentSize(20))
+	if n := q.DiskBytes(); n != want {
+		t.Fatalf("DiskBytes = %d after reopen, want %d", n, want)
+	}
+	if got := popN(t, q, -1); !slices.Equal(got, seq(6, 12)) {
+		t.Fatalf("got %v", got)
+	}
+	if n := q.DiskBytes(); n != 0 {
+		t.Fatalf("DiskBytes = %d, want 0", n)
+	}
+	q.close()
+}
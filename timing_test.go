@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+//偶数一直处理到超时为止
+func slowEven(ctx context.Context, n int) (int, error) {
+	if n%2 == 0 {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+	return n * 10, nil
+}
+
+func TestTimeoutMapDrop(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		h := NewStageHarness(t, TimeoutMap(time.Second, slowEven, DropOnTimeout), Synchronous())
+		h.Send(1, 2, 3)
+		h.Advance(time.Second)
+		ExpectEmissions(t, h.Close(), Emission[int]{10, 0}, Emission[int]{30, time.Second})
+		if err := h.Err(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestTimeoutMapFail(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		h := NewStageHarness(t, TimeoutMap(time.Second, slowEven, FailOnTimeout), Synchronous())
+		h.Send(1, 2, 3)
+		h.Advance(time.Second)
+		ExpectEmissions(t, h.Close(), Emission[int]{10, 0})
+		if err := h.Err(); !errors.Is(err, ErrItemTimeout) {
+			t.Fatalf("err = %v, want %v", err, ErrItemTimeout)
+		}
+	})
+}
+
+//d 不大于 0 时按 minWindow 处理，而不是让 NewTicker panic
+func TestSampleNonPositive(t *testing.T) {
+	for _, d := range []time.Duration{0, -time.Second} {
+		synctest.Test(t, func(t *testing.T) {
+			h := NewStageHarness(t, Sample[int](d), Synchronous())
+			h.Send(1, 2)
+			h.Advance(minWindow)
+			ExpectEmissions(t, h.Close(), Emission[int]{2, minWindow})
+		})
+		if _, err := Collect(context.Background(), From(FromSlice([]int{1, 2})).Pipe(Sample[int](d))); err != nil {
+			t.Fatalf("Sample(%v): %v", d, err)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+//原始 pipeline 的 *Pipe 适配器记录并行度和指标的名字，和 Flow 中的同名 stage 一样
+func TestDescribePipeline(t *testing.T) {
+	before := runtime.NumGoroutine()
+	m := NewMetrics()
+	topo := DescribePipeline(echo, ParallelPipe(4, square, Ordered), InstrumentPipe(m, "odd", odd), sum)
+
+	want := []TopoNode{
+		{ID: 0, Kind: "source", Name: "echo", FanOut: 1},
+		{ID: 1, Kind: "stage", Name: "orderedParallel", FanOut: 4},
+		{ID: 2, Kind: "stage", Name: "odd", FanOut: 1, Metrics: "odd"},
+		{ID: 3, Kind: "stage", Name: "sum", FanOut: 1},
+	}
+	if !reflect.DeepEqual(topo.Nodes, want) {
+		t.Fatalf("nodes = %+v, want %+v", topo.Nodes, want)
+	}
+	edges := []TopoEdge{{0, 1}, {1, 2}, {2, 3}}
+	if !reflect.DeepEqual(topo.Edges, edges) {
+		t.Fatalf("edges = %v, want %v", topo.Edges, edges)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("%d goroutines started while describing", n-before)
+	}
+}
+
+//运行中的原始 pipeline 可以通过 Handle 读取同样的拓扑结构
+func TestPipelineTopology(t *testing.T) {
+	out, h := pipelineWithHandle([]int{1, 2, 3}, echo, ParallelPipe(2, square, Unordered), sum)
+	for range out {
+	}
+	h.Wait()
+	nodes := h.Topology().Nodes
+	if len(nodes) != 3 || nodes[1].Name != "Parallel" || nodes[1].FanOut != 2 {
+		t.Fatalf("nodes = %+v", nodes)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+//不合法的窗口大小按最小值处理，不会让 NewTicker panic
+func TestTimeWindowInvalidSize(t *testing.T) {
+	stages := map[string]Stage[int, int]{
+		"tumbling d=0":   TumblingTime(0, 0, add),
+		"sliding size<0": SlidingTime(-time.Second, minWindow, 0, add),
+		"sliding step<0": SlidingTime(time.Second, -time.Second, 0, add),
+	}
+	for name, stage := range stages {
+		t.Run(name, func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				h := NewStageHarness(t, stage, Synchronous())
+				h.Send(1, 2)
+				h.Advance(minWindow)
+				got := h.Close()
+				if len(got) != 1 || got[0].Value != 3 {
+					t.Fatalf("got %v, want one window with 3", got)
+				}
+			})
+		})
+	}
+}
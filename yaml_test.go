@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want any
+	}{
+		{"empty", "# only a comment\n---\n", nil},
+		{"scalars", "int: 1\nfloat: 1.5\nstr: abc\nyes: true\nno: False\nnone: ~\nempty:", map[string]any{
+			"int": 1, "float": 1.5, "str": "abc", "yes": true, "no": false, "none": nil, "empty": nil,
+		}},
+		{"quoted", `a: "x: #1"` + "\nb: 'it''s'\n\"c d\": 2", map[string]any{"a": "x: #1", "b": "it's", "c d": 2}},
+		{"comments", "a: 1 # one\nb: x#y", map[string]any{"a": 1, "b": "x#y"}},
+		{"nested map", "source:\n  name: range\n  params:\n    from: 1\n    to: 3\nlast: 1", map[string]any{
+			"source": map[string]any{"name": "range", "params": map[string]any{"from": 1, "to": 3}},
+			"last":   1,
+		}},
+		{"list same indent", "nums:\n- 1\n- 2", map[string]any{"nums": []any{1, 2}}},
+		{"list deeper indent", "nums:\n  - 1\n  - two", map[string]any{"nums": []any{1, "two"}}},
+		{"list of maps", "stages:\n  - name: window_sum\n    params: {size: 3}\n  - name: sum", map[string]any{
+			"stages": []any{
+				map[string]any{"name": "window_sum", "params": map[string]any{"size": 3}},
+				map[string]any{"name": "sum"},
+			},
+		}},
+		{"nested list", "- - 1\n  - 2\n-\n  - 3", []any{[]any{1, 2}, []any{3}}},
+		{"flow", `a: [1, "b, c", [2], {k: v, n: [3]}]` + "\nb: {}\nc: []", map[string]any{
+			"a": []any{1, "b, c", []any{2}, map[string]any{"k": "v", "n": []any{3}}},
+			"b": map[string]any{},
+			"c": []any{},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseYAML(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		err  string
+	}{
+		{"tab", "a:\n\tb: 1", "line 2: tabs"},
+		{"tab after spaces", "a:\n  \tb: 1", "line 2: tabs"},
+		{"deeper indentation", "a: 1\n  b: 2", "line 2: unexpected indentation"},
+		{"dedent to unknown level", "a:\n    b: 1\n  c: 2", "line 3: unexpected indentation"},
+		{"list after map", "a: 1\n- 2", "line 2: unexpected indentation"},
+		{"missing colon", "a: 1\nb", `line 2: expected "key: value"`},
+		{"duplicate key", "a: 1\na: 2", `line 2: duplicate key "a"`},
+		{"unterminated list", "a: [1, 2", "line 1: unterminated list"},
+		{"unterminated map", "a: {k: v", "line 1: unterminated map"},
+		{"unbalanced", "a: [1, [2]", "line 1: unbalanced"},
+		{"flow map without key", "a: {k}", `line 1: expected "key: value"`},
+		{"bad string", `a: "abc`, "line 1: bad string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseYAML(tt.src)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParsePipelineDefYAML(t *testing.T) {
+	def, err := ParsePipelineDefYAML([]byte(`
+source:
+  name: range
+  params: {from: 1, to: 100}
+stages:
+  - name: window_sum
+    params:
+      size: 3
+  - name: sum
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ParsePipelineDef([]byte(`{
+		"source": {"name": "range", "params": {"from": 1, "to": 100}},
+		"stages": [{"name": "window_sum", "params": {"size": 3}}, {"name": "sum"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(def, want) {
+		t.Fatalf("got %+v, want %+v", def, want)
+	}
+
+	//不认识的 key 是错误，不会被忽略
+	for _, src := range []string{
+		"source: {name: range}\nstage:\n  - name: sum",
+		"source: {name: range, param: {to: 3}}",
+	} {
+		if _, err := ParsePipelineDefYAML([]byte(src)); err == nil || !strings.Contains(err.Error(), "unknown field") {
+			t.Errorf("%q: err = %v, want unknown field", src, err)
+		}
+	}
+}
+
+//单个数字的 nums 在 JSON、YAML 和命令行中的结果相同
+func TestEchoScalarNums(t *testing.T) {
+	r := NewRegistry()
+	yamlDef, err := ParsePipelineDefYAML([]byte("source: {name: echo, params: {nums: 5}}\nstages:\n  - name: square"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonDef, err := ParsePipelineDef([]byte(`{"source": {"name": "echo", "params": {"nums": 5}}, "stages": [{"name": "square"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exprDef, err := ParsePipeExpr(r, "echo 5 | square")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, def := range map[string]*PipelineDef{"yaml": yamlDef, "json": jsonDef, "expr": exprDef} {
+		flow, err := r.Build(def)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		got, err := Collect(context.Background(), flow)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !reflect.DeepEqual(got, []int{25}) {
+			t.Fatalf("%s: got %v, want [25]", name, got)
+		}
+	}
+}